@@ -0,0 +1,80 @@
+package cloudwatch
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the options whose text may refer to the AccountID, besides the templated
+// options
+var accountOptions = []string{
+	`LOGSPOUT_CLOUDWATCH_STREAM_HEADER`,
+	`LOGSPOUT_CLOUDWATCH_GROUP_EXPR`,
+	`LOGSPOUT_CLOUDWATCH_STREAM_EXPR`,
+}
+
+// the AWS account ID of an adapter's credentials, which is only asked of STS
+// when a template may render it, as the request is slow, or fails, where
+// STS can't be reached.
+type accountCache struct {
+	sync.Mutex
+	id      string
+	fetched bool // whether STS has been asked, or the ID was set
+}
+
+// returns whether any of the route's templates refer to the AccountID
+func routeUsesAccountID(route *router.Route) bool {
+	for key := range templatedOptions {
+		if strings.Contains(routeOption(route, key, ""), `AccountID`) {
+			return true
+		}
+	}
+	for _, key := range accountOptions {
+		if strings.Contains(routeOption(route, key, ""), `AccountID`) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether any templates set in a container's environment refer to
+// the AccountID
+func envUsesAccountID(env map[string]string) bool {
+	for key := range templatedOptions {
+		if strings.Contains(env[key], `AccountID`) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountID returns the AWS account ID of the adapter's credentials, if it
+// is known yet, from any goroutine.
+func (a *CloudwatchAdapter) AccountID() string {
+	a.account.Lock()
+	defer a.account.Unlock()
+	return a.account.id
+}
+
+// returns the AWS account ID of the adapter's credentials, asking STS for it
+// the first time, from any goroutine.
+func (a *CloudwatchAdapter) fetchAccountID() string {
+	a.account.Lock()
+	defer a.account.Unlock()
+	if !a.account.fetched {
+		a.account.fetched = true
+		a.account.id = a.batcher.uploader.accountID()
+	}
+	return a.account.id
+}
+
+// returns the AWS account ID for rendering a container's templates: fetched
+// if the route's templates, or the container's own, may use it.
+func (a *CloudwatchAdapter) contextAccountID(env map[string]string) string {
+	if a.accountInTemplates || envUsesAccountID(env) {
+		return a.fetchAccountID()
+	}
+	return a.AccountID()
+}
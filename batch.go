@@ -1,6 +1,12 @@
 package cloudwatch
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 // CloudwatchMessage is a simple JSON input to Cloudwatch.
 type CloudwatchMessage struct {
@@ -9,26 +15,85 @@ type CloudwatchMessage struct {
 	Stream    string    `json:"stream"`
 	Time      time.Time `json:"time"`
 	Container string    `json:"container"`
+	Role      string    `json:"role"`    // IAM role ARN to assume, if any
+	Seq       uint64    `json:"seq"`     // numbers messages in order of arrival
+	Arrived   time.Time `json:"arrived"` // when logspout received it
+	Output    string    `json:"output"`  // stdout or stderr, for container lines
+	// identifies the sending container in warnings and errors
+	ContainerName string `json:"container_name"`
+	ContainerID   string `json:"container_id"`
+	Label         string `json:"label,omitempty"` // LOGSPOUT_CLOUDWATCH_ERROR_LABEL
+	// the container's labels, added to JSON events
+	Attributes labelSet `json:"attributes,omitempty"`
+}
+
+// describes the container that sent the message, for warnings and errors
+func (msg CloudwatchMessage) source() string {
+	id := shortID(msg.ContainerID)
+	if msg.Label != "" {
+		return fmt.Sprintf("%s (%s, %s)", msg.ContainerName, id, msg.Label)
+	}
+	return fmt.Sprintf("%s (%s)", msg.ContainerName, id)
+}
+
+// returns the message with the given prefix added to its text
+func (msg CloudwatchMessage) prefixed(prefix string) CloudwatchMessage {
+	msg.Message = prefix + msg.Message
+	return msg
+}
+
+// identifies a log stream within its log group, and the IAM role assumed to
+// reach it, since the same names may exist in several AWS accounts
+type streamID struct {
+	Group  string
+	Stream string
+	Role   string
+}
+
+// returns the log stream the message is destined for
+func (msg CloudwatchMessage) logStream() streamID {
+	return streamID{Group: msg.Group, Stream: msg.Stream, Role: msg.Role}
 }
 
 type CloudwatchBatch struct {
-	Msgs []CloudwatchMessage
-	Size int64
+	Msgs    []CloudwatchMessage
+	Size    int64
+	Created time.Time
 }
 
 // Rules for creating Cloudwatch Log batches, from https://goo.gl/TrIN8c
 const MAX_BATCH_COUNT = 10000  // messages
 const MAX_BATCH_SIZE = 1048576 // bytes
 const MSG_OVERHEAD = 26        // bytes
+const MAX_EVENT_SIZE = 262144  // bytes, including MSG_OVERHEAD
+const MAX_BATCH_SPAN = 24 * time.Hour
+const MAX_EVENT_AGE = 14 * 24 * time.Hour
+const MAX_EVENT_SKEW = 2 * time.Hour // how far into the future
 
+// returns the size a message counts for against MAX_BATCH_SIZE: its text in
+// UTF-8 bytes, as AWS counts it, plus the per-event overhead
 func msgSize(msg CloudwatchMessage) int64 {
-	return int64((len(msg.Message) * 8) + MSG_OVERHEAD)
+	return int64(len(msg.Message) + MSG_OVERHEAD)
+}
+
+// describes the containers whose messages are in the batch
+func (b CloudwatchBatch) sources() string {
+	sources := []string{}
+	seen := map[string]bool{}
+	for _, msg := range b.Msgs {
+		if source := msg.source(); !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return strings.Join(sources, ", ")
 }
 
 func NewCloudwatchBatch() *CloudwatchBatch {
 	return &CloudwatchBatch{
-		Msgs: []CloudwatchMessage{},
-		Size: 0,
+		Msgs:    []CloudwatchMessage{},
+		Size:    0,
+		Created: time.Now(),
 	}
 }
 
@@ -36,3 +101,100 @@ func (b *CloudwatchBatch) Append(msg CloudwatchMessage) {
 	b.Msgs = append(b.Msgs, msg)
 	b.Size = b.Size + msgSize(msg)
 }
+
+// describes the size of the batch's messages, and their size with the
+// per-message overhead, against the batch size limit
+func (b CloudwatchBatch) describeSize() string {
+	raw := int64(0)
+	for _, msg := range b.Msgs {
+		raw += int64(len(msg.Message))
+	}
+	return fmt.Sprintf("%s of messages, %s of %s with overhead",
+		formatBytes(raw), formatBytes(b.Size), formatBytes(MAX_BATCH_SIZE))
+}
+
+// returns a byte count in binary units, such as "512 B" or "1.5 KiB"
+func formatBytes(bytes int64) string {
+	if bytes < 1024 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, unit := float64(bytes)/1024, "KiB"
+	for _, larger := range []string{"MiB", "GiB"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, larger
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// a problem found in a batch before it was uploaded, and how it was handled
+type batchProblem struct {
+	Text   string
+	Sample string // the affected message's original text, if any
+}
+
+// checks the batch against the PutLogEvents limits before it is uploaded, so
+// requests that would be rejected aren't sent. Messages are sorted by time,
+// then arrival, as events must be in chronological order. Empty messages and
+// messages outside the accepted time window are dropped, invalid UTF-8 is
+// replaced, oversized messages are truncated, and the batch is split wherever
+// it would exceed the limits on count, size or time span - leaving room for
+// a batch marker, if markers are enabled. Returns the batches to upload, and
+// each problem that was handled.
+func (b CloudwatchBatch) validate(now time.Time, markers bool) ([]CloudwatchBatch, []batchProblem) {
+	reservedCount, reservedSize := 0, int64(0)
+	if markers {
+		reservedCount, reservedSize = 1, markerSize()
+	}
+	batches := []CloudwatchBatch{}
+	problems := []batchProblem{}
+	current := NewCloudwatchBatch()
+	sort.SliceStable(b.Msgs, func(i, j int) bool {
+		if !b.Msgs[i].Time.Equal(b.Msgs[j].Time) {
+			return b.Msgs[i].Time.Before(b.Msgs[j].Time)
+		}
+		return b.Msgs[i].Seq < b.Msgs[j].Seq
+	})
+	for _, msg := range b.Msgs {
+		if len(msg.Message) == 0 {
+			problems = append(problems, batchProblem{
+				Text: "dropped empty message from " + msg.source()})
+			continue
+		}
+		if msg.Time.Before(now.Add(-MAX_EVENT_AGE)) ||
+			msg.Time.After(now.Add(MAX_EVENT_SKEW)) {
+			problems = append(problems, batchProblem{Text: fmt.Sprintf(
+				"dropped message from %s with timestamp %s outside the accepted window",
+				msg.source(), msg.Time.Format(time.RFC3339)), Sample: msg.Message})
+			continue
+		}
+		if !utf8.ValidString(msg.Message) {
+			problems = append(problems, batchProblem{Text: fmt.Sprintf(
+				"replaced invalid UTF-8 in message from %s", msg.source()),
+				Sample: msg.Message})
+			msg.Message = strings.ToValidUTF8(msg.Message, "\uFFFD")
+		}
+		if len(msg.Message)+MSG_OVERHEAD > MAX_EVENT_SIZE {
+			problems = append(problems, batchProblem{Text: fmt.Sprintf(
+				"truncated message of %d bytes from %s", len(msg.Message), msg.source()),
+				Sample: msg.Message})
+			msg.Message = strings.ToValidUTF8(
+				msg.Message[:MAX_EVENT_SIZE-MSG_OVERHEAD], "")
+		}
+		if len(current.Msgs) > 0 &&
+			((current.Size+msgSize(msg)+reservedSize) > MAX_BATCH_SIZE ||
+				len(current.Msgs)+reservedCount >= MAX_BATCH_COUNT ||
+				msg.Time.Sub(current.Msgs[0].Time) > MAX_BATCH_SPAN) {
+			problems = append(problems, batchProblem{Text: fmt.Sprintf(
+				"split batch after %d messages", len(current.Msgs))})
+			batches = append(batches, *current)
+			current = NewCloudwatchBatch()
+		}
+		current.Append(msg)
+	}
+	if len(current.Msgs) > 0 {
+		batches = append(batches, *current)
+	}
+	return batches, problems
+}
@@ -0,0 +1,105 @@
+package cloudwatch
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// returns a batch of count messages of the given text, a millisecond apart
+func testBatch(now time.Time, count int, text string) CloudwatchBatch {
+	batch := NewCloudwatchBatch()
+	for i := 0; i < count; i++ {
+		batch.Append(CloudwatchMessage{Message: text, Group: `g`, Stream: `s`,
+			Time: now.Add(time.Duration(i) * time.Millisecond), Seq: uint64(i)})
+	}
+	return *batch
+}
+
+func TestValidateSplitsOnCount(t *testing.T) {
+	now := time.Now()
+	batches, _ := testBatch(now, MAX_BATCH_COUNT+1, `x`).validate(now, false)
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	if count := len(batches[0].Msgs) + len(batches[1].Msgs); count != MAX_BATCH_COUNT+1 {
+		t.Errorf("got %d messages, want %d", count, MAX_BATCH_COUNT+1)
+	}
+}
+
+func TestValidateSplitsOnSize(t *testing.T) {
+	now := time.Now()
+	text := strings.Repeat(`x`, 100000)
+	batches, _ := testBatch(now, 20, text).validate(now, false)
+	if len(batches) < 2 {
+		t.Fatalf("got %d batches, want the messages split", len(batches))
+	}
+	for _, batch := range batches {
+		if batch.Size > MAX_BATCH_SIZE {
+			t.Errorf("batch of %d bytes is over the limit", batch.Size)
+		}
+	}
+}
+
+func TestValidateKeepsBatchUnderSizeLimit(t *testing.T) {
+	now := time.Now()
+	count := 4
+	text := strings.Repeat(`x`, MAX_BATCH_SIZE/count-MSG_OVERHEAD-1)
+	batches, problems := testBatch(now, count, text).validate(now, false)
+	if len(batches) != 1 || len(problems) != 0 {
+		t.Errorf("%d bytes were split into %d batches, want 1",
+			count*len(text), len(batches))
+	}
+}
+
+func TestValidateTruncatesOversizedMessages(t *testing.T) {
+	now := time.Now()
+	text := strings.Repeat(`é`, MAX_EVENT_SIZE) // two bytes each
+	batches, problems := testBatch(now, 1, text).validate(now, false)
+	if len(batches) != 1 || len(problems) != 1 {
+		t.Fatalf("got %d batches and %d problems, want 1 of each",
+			len(batches), len(problems))
+	}
+	message := batches[0].Msgs[0].Message
+	if len(message)+MSG_OVERHEAD > MAX_EVENT_SIZE {
+		t.Errorf("message of %d bytes is still oversized", len(message))
+	}
+	if !utf8.ValidString(message) {
+		t.Error("truncated message is not valid UTF-8")
+	}
+}
+
+func TestValidateDropsAndSorts(t *testing.T) {
+	now := time.Now()
+	batch := NewCloudwatchBatch()
+	batch.Append(CloudwatchMessage{Message: `late`, Time: now, Seq: 2})
+	batch.Append(CloudwatchMessage{Message: ``, Time: now, Seq: 3})
+	batch.Append(CloudwatchMessage{Message: `old`, Time: now.Add(-MAX_EVENT_AGE - time.Hour)})
+	batch.Append(CloudwatchMessage{Message: `early`, Time: now, Seq: 1})
+	batches, problems := batch.validate(now, false)
+	if len(problems) != 2 {
+		t.Errorf("got %d problems, want 2", len(problems))
+	}
+	if len(batches) != 1 || len(batches[0].Msgs) != 2 ||
+		batches[0].Msgs[0].Message != `early` || batches[0].Msgs[1].Message != `late` {
+		t.Errorf("got %+v, want early then late", batches)
+	}
+}
+
+func TestDescribeSize(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		count int
+		text  string
+		want  string
+	}{
+		{1, strings.Repeat(`x`, 100), `100 B of messages, 126 B of 1.0 MiB with overhead`},
+		{3, strings.Repeat(`x`, 512), `1.5 KiB of messages, 1.6 KiB of 1.0 MiB with overhead`},
+		{4, strings.Repeat(`x`, 200000), `781.2 KiB of messages, 781.4 KiB of 1.0 MiB with overhead`},
+	} {
+		if got := testBatch(now, test.count, test.text).describeSize(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
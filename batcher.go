@@ -2,6 +2,7 @@ package cloudwatch
 
 import (
 	"log"
+	"math/rand"
 	"os"
 	"strconv"
 	"time"
@@ -10,30 +11,96 @@ import (
 )
 
 const DEFAULT_DELAY = 4 //seconds
+const DEFAULT_ADAPTIVE_MAX_AGE = 30 * time.Second
+const DEFAULT_PACE_MAX_AGE = time.Minute
+
+// LOGSPOUT_CLOUDWATCH_FLUSH_ALIGN modes
+const ALIGN_CLOCK = "clock"   // submit on wall-clock multiples of the delay
+const ALIGN_JITTER = "jitter" // the same, offset by a random per-host amount
+
+// LOGSPOUT_CLOUDWATCH_TIMESTAMPS modes
+const TIMESTAMPS_RECEIVED = "received" // when logspout received the line
+const TIMESTAMPS_FLUSHED = "flushed"   // when its batch was submitted
 
 // CloudwatchBatcher receieves Cloudwatch messages on its input channel,
 // stores them in CloudwatchBatches until enough data is ready to send, then
 // sends each CloudwatchMessageBatch on its output channel.
 type CloudwatchBatcher struct {
-	Input  chan CloudwatchMessage
-	output chan CloudwatchBatch
-	route  *router.Route
-	timer  chan bool
-	// maintain a batch for each container, indexed by its name
-	batches map[string]*CloudwatchBatch
+	Input    chan CloudwatchMessage
+	output   chan CloudwatchBatch
+	uploader *CloudwatchUploader
+	route    *router.Route
+	timer    chan bool
+	delay    time.Duration // how often all batches are submitted
+	// with alignment, batches are submitted on wall-clock multiples of the
+	// delay, plus an offset - random in jitter mode, so hosts are spread out
+	align  string
+	offset time.Duration
+	// small batches wait for more messages, up to a maximum age
+	adaptiveMinEvents int
+	adaptiveMaxAge    time.Duration
+	// new batches wait at least this long, so bursts land in one request
+	coalesceDelay time.Duration
+	// batches the uploader doesn't take within this long are dropped
+	sendTimeout time.Duration
+	// whether events are timestamped when received, or when submitted
+	timestamps string
+	// when pacing, each stream's events are released at this rate per second
+	pace       int
+	paceMaxAge time.Duration
+	paced      map[streamID][]CloudwatchMessage
+	// requests for the state of the streams
+	snapshots chan *snapshotRequest
+	stats     *Counters
+	// maintain a batch for each log stream
+	batches map[streamID]*CloudwatchBatch
 }
 
 // constructor for CloudwatchBatcher - requires the adapter
-func NewCloudwatchBatcher(adapter *CloudwatchAdapter) *CloudwatchBatcher {
+func NewCloudwatchBatcher(adapter *CloudwatchAdapter) (*CloudwatchBatcher, error) {
+	uploader, err := NewCloudwatchUploader(adapter)
+	if err != nil {
+		return nil, err
+	}
 	batcher := CloudwatchBatcher{
-		Input:   make(chan CloudwatchMessage),
-		output:  NewCloudwatchUploader(adapter).Input,
-		batches: map[string]*CloudwatchBatch{},
-		timer:   make(chan bool),
-		route:   adapter.Route,
+		Input:    make(chan CloudwatchMessage),
+		output:   uploader.Input,
+		uploader: uploader,
+		batches:  map[streamID]*CloudwatchBatch{},
+		timer:    make(chan bool),
+		route:    adapter.Route,
+		delay:    time.Duration(parseDelay(adapter.Route)) * time.Second,
+		adaptiveMinEvents: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ADAPTIVE_MIN_EVENTS`, 0),
+		adaptiveMaxAge: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ADAPTIVE_MAX_AGE`, DEFAULT_ADAPTIVE_MAX_AGE),
+		coalesceDelay: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_COALESCE_DELAY`, 0),
+		sendTimeout: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_SEND_TIMEOUT`, 0),
+		timestamps: routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_TIMESTAMPS`,
+			TIMESTAMPS_RECEIVED),
+		stats: adapter.stats,
+		pace: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_EVENTS_PER_SECOND`, 0),
+		paceMaxAge: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_PACE_MAX_AGE`, DEFAULT_PACE_MAX_AGE),
+		paced:     map[streamID][]CloudwatchMessage{},
+		snapshots: make(chan *snapshotRequest),
+	}
+	if batcher.coalesceDelay > batcher.adaptiveMaxAge {
+		log.Printf("cloudwatch: WARNING LOGSPOUT_CLOUDWATCH_COALESCE_DELAY %s is "+
+			"over the max age of a batch, using %s\n",
+			batcher.coalesceDelay, batcher.adaptiveMaxAge)
+		batcher.coalesceDelay = batcher.adaptiveMaxAge
+	}
+	batcher.align = routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_FLUSH_ALIGN`, "")
+	if batcher.align == ALIGN_JITTER && batcher.delay > 0 {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		batcher.offset = time.Duration(random.Int63n(int64(batcher.delay)))
 	}
 	go batcher.Start()
-	return &batcher
+	return &batcher, nil
 }
 
 // Main loop for the Batcher - just sorts each messages into a batch, but
@@ -46,30 +113,156 @@ func (b *CloudwatchBatcher) Start() {
 			if len(msg.Message) == 0 { // empty messages are not allowed
 				break
 			}
-			// get or create the correct slice of messages for this message
-			if _, exists := b.batches[msg.Container]; !exists {
-				b.batches[msg.Container] = NewCloudwatchBatch()
+			if b.pace > 0 {
+				b.hold(msg)
+			} else {
+				b.add(msg)
 			}
-			// if Msg is too long for the current batch, submit the batch
-			if (b.batches[msg.Container].Size+msgSize(msg)) > MAX_BATCH_SIZE ||
-				len(b.batches[msg.Container].Msgs) >= MAX_BATCH_COUNT {
-				b.output <- *b.batches[msg.Container]
-				b.batches[msg.Container] = NewCloudwatchBatch()
-			}
-			thisBatch := b.batches[msg.Container]
-			thisBatch.Append(msg)
-		case <-b.timer: // submit and delete all existing batches
-			for container, batch := range b.batches {
-				b.output <- *batch
-				delete(b.batches, container)
+		case request := <-b.snapshots:
+			b.fillSnapshot(request)
+		case <-b.timer: // submit and delete all batches that are ready
+			b.release()
+			for stream, batch := range b.batches {
+				if !b.ready(batch) {
+					continue
+				}
+				b.send(*batch)
+				delete(b.batches, stream)
 			}
 		}
 	}
 }
 
+// adds a message to its stream's batch, submitting the batch first if the
+// message would make it too large
+func (b *CloudwatchBatcher) add(msg CloudwatchMessage) {
+	// get or create the correct slice of messages for this message
+	stream := msg.logStream()
+	if _, exists := b.batches[stream]; !exists {
+		b.batches[stream] = NewCloudwatchBatch()
+	}
+	// if Msg is too long for the current batch, submit the batch
+	if (b.batches[stream].Size+msgSize(msg)) > MAX_BATCH_SIZE ||
+		len(b.batches[stream].Msgs) >= MAX_BATCH_COUNT {
+		b.send(*b.batches[stream])
+		b.batches[stream] = NewCloudwatchBatch()
+	}
+	b.batches[stream].Append(msg)
+}
+
+// holds a message back in its stream's pacing queue, when pacing. Each queue
+// holds no more than LOGSPOUT_CLOUDWATCH_PACE_MAX_AGE's worth of events at
+// the paced rate, so none waits longer than that; beyond it, messages are
+// dropped.
+func (b *CloudwatchBatcher) hold(msg CloudwatchMessage) {
+	stream := msg.logStream()
+	limit := int(float64(b.pace) * b.paceMaxAge.Seconds())
+	if len(b.paced[stream]) >= limit && len(b.paced[stream]) > 0 {
+		b.stats.Add(`pace_dropped`, 1)
+		return
+	}
+	b.paced[stream] = append(b.paced[stream], msg)
+}
+
+// moves as many messages from each stream's pacing queue into its batch as
+// the paced rate allows for one timer tick - at least one.
+func (b *CloudwatchBatcher) release() {
+	allowance := int(float64(b.pace) * b.delay.Seconds())
+	if allowance < 1 {
+		allowance = 1
+	}
+	for stream, queue := range b.paced {
+		count := allowance
+		if count > len(queue) {
+			count = len(queue)
+		}
+		for _, msg := range queue[:count] {
+			b.add(msg)
+		}
+		if count == len(queue) {
+			delete(b.paced, stream)
+		} else {
+			b.paced[stream] = queue[count:]
+		}
+	}
+}
+
+// returns whether a batch should be submitted when the timer fires. A batch
+// started less than the coalescing delay ago is held for the next tick, so
+// that a burst arriving just before the timer isn't split across requests.
+// In adaptive mode, a batch with fewer than the minimum number of messages is
+// held for later timer ticks, until it reaches its maximum age, so quiet
+// streams send fewer, fuller requests.
+func (b *CloudwatchBatcher) ready(batch *CloudwatchBatch) bool {
+	if time.Since(batch.Created) < b.coalesceDelay {
+		return false
+	}
+	if b.adaptiveMinEvents > 0 && len(batch.Msgs) < b.adaptiveMinEvents {
+		return time.Since(batch.Created) >= b.adaptiveMaxAge
+	}
+	return true
+}
+
+// sends a batch on to the uploader. With a send timeout, a batch that the
+// uploader doesn't take in time, because its queue is full while AWS is slow,
+// is dropped, so a stalled uploader can't block the batcher - and with it,
+// the reading of container logs - indefinitely.
+func (b *CloudwatchBatcher) send(batch CloudwatchBatch) {
+	b.stamp(batch, time.Now())
+	if b.sendTimeout <= 0 {
+		b.output <- batch
+		return
+	}
+	timer := time.NewTimer(b.sendTimeout)
+	defer timer.Stop()
+	select {
+	case b.output <- batch:
+	case <-timer.C:
+		b.stats.Add(`send_timeout_dropped`, int64(len(batch.Msgs)))
+		log.Printf("cloudwatch: WARNING uploader busy for %s, dropped %d messages from %s\n",
+			b.sendTimeout, len(batch.Msgs), batch.sources())
+	}
+}
+
+// restamps a batch's events with the time it is submitted, if timestamps
+// are of delivery rather than of receipt. They all get the same timestamp,
+// so they keep their order. Times in the text, such as a JSON event's
+// @timestamp, were formatted when received, and are left as they were.
+func (b *CloudwatchBatcher) stamp(batch CloudwatchBatch, now time.Time) {
+	if b.timestamps != TIMESTAMPS_FLUSHED {
+		return
+	}
+	for i := range batch.Msgs {
+		batch.Msgs[i].Time = now
+	}
+}
+
 func (b *CloudwatchBatcher) RunTimer() {
+	for {
+		time.Sleep(time.Until(b.nextFlush(time.Now())))
+		b.timer <- true
+	}
+}
+
+// returns when batches should next be submitted, after the given time: one
+// delay later, or with alignment, at the next wall-clock multiple of the
+// delay (plus this host's offset), so uploads happen at predictable times.
+func (b *CloudwatchBatcher) nextFlush(now time.Time) time.Time {
+	if b.align == "" || b.delay <= 0 {
+		return now.Add(b.delay)
+	}
+	next := now.Truncate(b.delay).Add(b.offset)
+	for !next.After(now) {
+		next = next.Add(b.delay)
+	}
+	return next
+}
+
+// returns the DELAY between submissions in seconds, from the route options
+// or the OS environment, which takes precedence.
+func parseDelay(route *router.Route) int {
 	delayText := strconv.Itoa(DEFAULT_DELAY)
-	if routeDelay, isSet := b.route.Options[`DELAY`]; isSet {
+	if routeDelay, isSet := route.Options[`DELAY`]; isSet {
 		delayText = routeDelay
 	}
 	if envDelay := os.Getenv(`DELAY`); envDelay != "" {
@@ -81,8 +274,5 @@ func (b *CloudwatchBatcher) RunTimer() {
 			delayText, DEFAULT_DELAY)
 		delay = DEFAULT_DELAY
 	}
-	for {
-		time.Sleep(time.Duration(delay) * time.Second)
-		b.timer <- true
-	}
+	return delay
 }
@@ -0,0 +1,135 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStampKeepsOrRestampsTimestamps(t *testing.T) {
+	received := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	flushed := received.Add(4 * time.Second) // the injected clock
+	a := &CloudwatchAdapter{jsonFields: []string{}, stats: NewCounters()}
+	for mode, want := range map[string]time.Time{
+		TIMESTAMPS_RECEIVED: received,
+		TIMESTAMPS_FLUSHED:  flushed,
+	} {
+		batch := NewCloudwatchBatch()
+		batch.Append(a.format(CloudwatchMessage{Message: `first`, Time: received}))
+		batch.Append(a.format(CloudwatchMessage{Message: `second`, Time: received}))
+		(&CloudwatchBatcher{timestamps: mode}).stamp(*batch, flushed)
+		for _, msg := range batch.Msgs {
+			if !msg.Time.Equal(want) {
+				t.Errorf("%s: event timestamped %s, want %s", mode, msg.Time, want)
+			}
+			// the JSON fields keep the time the line was received
+			event := map[string]string{}
+			json.Unmarshal([]byte(msg.Message), &event)
+			if event[`@timestamp`] != `2024-05-01T13:00:00.000Z` {
+				t.Errorf("%s: @timestamp is %s, want the time received",
+					mode, event[`@timestamp`])
+			}
+		}
+	}
+}
+
+func TestCoalesceDelayIsBoundedByMaxAge(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{
+		`LOGSPOUT_CLOUDWATCH_COALESCE_DELAY`:   `1m`,
+		`LOGSPOUT_CLOUDWATCH_ADAPTIVE_MAX_AGE`: `10s`,
+	})
+	if a.batcher.coalesceDelay != 10*time.Second {
+		t.Errorf("coalesce delay is %s, want the max age", a.batcher.coalesceDelay)
+	}
+}
+
+func TestBurstIsCoalescedIntoOneUpload(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_COALESCE_DELAY`: `500ms`})
+	for i := 0; i < 50; i++ {
+		a.batcher.Input <- CloudwatchMessage{Message: fmt.Sprintf("line %d", i),
+			Group: `g`, Stream: `s`, Time: time.Now()}
+	}
+	f.await(t, "the burst", func() bool { return len(f.messages(`g`, `s`)) == 50 })
+	if count := f.count(`PutLogEvents`); count != 1 {
+		t.Errorf("the burst took %d uploads, want 1", count)
+	}
+}
+
+func TestSendTimeoutDropsUntakenBatches(t *testing.T) {
+	b := &CloudwatchBatcher{output: make(chan CloudwatchBatch),
+		sendTimeout: 10 * time.Millisecond, stats: NewCounters()}
+	batch := NewCloudwatchBatch()
+	batch.Append(CloudwatchMessage{Message: `stalled`, Container: `c`, Time: time.Now()})
+	batch.Append(CloudwatchMessage{Message: `stalled`, Container: `c`, Time: time.Now()})
+	b.send(*batch) // nobody takes it
+	if dropped := b.stats.Snapshot()[`send_timeout_dropped`]; dropped != 2 {
+		t.Errorf("dropped %d messages, want 2", dropped)
+	}
+	taken := make(chan CloudwatchBatch, 1)
+	go func() { taken <- <-b.output }()
+	b.send(*batch)
+	if len((<-taken).Msgs) != 2 {
+		t.Error("the batch taken in time was not sent")
+	}
+	if dropped := b.stats.Snapshot()[`send_timeout_dropped`]; dropped != 2 {
+		t.Errorf("dropped %d messages in all, want 2", dropped)
+	}
+}
+
+func TestNextFlushAlignsToTheClock(t *testing.T) {
+	now := time.Date(2024, 5, 1, 13, 0, 7, 0, time.UTC)
+	for _, test := range []struct {
+		align  string
+		offset time.Duration
+		want   time.Time
+	}{
+		{"", 0, now.Add(10 * time.Second)},
+		{ALIGN_CLOCK, 0, now.Add(3 * time.Second)},
+		{ALIGN_JITTER, 5 * time.Second, now.Add(8 * time.Second)},
+		{ALIGN_JITTER, 9 * time.Second, now.Add(2 * time.Second)},
+	} {
+		b := &CloudwatchBatcher{delay: 10 * time.Second, align: test.align,
+			offset: test.offset}
+		if next := b.nextFlush(now); !next.Equal(test.want) {
+			t.Errorf("%q with offset %s: flushes at %s, want %s",
+				test.align, test.offset, next, test.want)
+		}
+	}
+	b := &CloudwatchBatcher{delay: 10 * time.Second, align: ALIGN_CLOCK}
+	boundary := now.Truncate(10 * time.Second)
+	if next := b.nextFlush(boundary); !next.Equal(boundary.Add(10 * time.Second)) {
+		t.Errorf("flushes at %s on a boundary, want the next one", next)
+	}
+}
+
+func TestPacingReleasesEventsAtTheRate(t *testing.T) {
+	b := &CloudwatchBatcher{pace: 2, paceMaxAge: 3 * time.Second,
+		delay: time.Second, stats: NewCounters(),
+		paced: map[streamID][]CloudwatchMessage{}, batches: map[streamID]*CloudwatchBatch{}}
+	msg := CloudwatchMessage{Group: `g`, Stream: `s`}
+	for i := 0; i < 10; i++ {
+		msg.Message = fmt.Sprintf("line %d", i)
+		b.hold(msg)
+	}
+	// the queue holds the max age's worth of events, 3s at 2 a second
+	if dropped := b.stats.Snapshot()[`pace_dropped`]; dropped != 4 {
+		t.Errorf("dropped %d messages, want 4", dropped)
+	}
+	for tick, want := range []int{2, 4, 6, 6} {
+		b.release()
+		batch := b.batches[msg.logStream()]
+		if len(batch.Msgs) != want {
+			t.Fatalf("tick %d: released %d messages, want %d", tick, len(batch.Msgs), want)
+		}
+	}
+	if len(b.paced) != 0 {
+		t.Errorf("still holding %v", b.paced)
+	}
+	if first := b.batches[msg.logStream()].Msgs[0].Message; first != `line 0` {
+		t.Errorf("released %q first, want the oldest", first)
+	}
+}
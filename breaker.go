@@ -0,0 +1,67 @@
+package cloudwatch
+
+import "time"
+
+// Defaults for the circuit breaker around Docker API calls
+const DEFAULT_DOCKER_FAILURES = 5                   // consecutive failures
+const DEFAULT_DOCKER_COOLDOWN = 30 * time.Second    // before trying again
+const DEFAULT_DOCKER_MAX_COOLDOWN = 5 * time.Minute // when backing off
+const DEFAULT_DOCKER_TIMEOUT = 10 * time.Second     // for each API call
+
+// CircuitBreaker stops calls to a failing service once a number of calls in
+// a row have failed, then lets calls through again after a cooldown, to see
+// whether the service has recovered. Each time that trial call fails too,
+// the cooldown doubles, up to a maximum, so a service that is down for long
+// (such as a restarting Docker daemon) is retried with backoff. It is not
+// safe for concurrent use.
+type CircuitBreaker struct {
+	Threshold   int           // consecutive failures that open the breaker
+	Cooldown    time.Duration // how long the breaker first stays open
+	MaxCooldown time.Duration // the longest the breaker stays open
+	failures    int
+	backoff     time.Duration // how long the breaker last stayed open
+	openUntil   time.Time
+}
+
+// returns whether a call should be attempted
+func (b *CircuitBreaker) Allow() bool {
+	return !time.Now().Before(b.openUntil)
+}
+
+// returns when the breaker will next let calls through
+func (b *CircuitBreaker) OpenUntil() time.Time {
+	return b.openUntil
+}
+
+// records a successful call, closing the breaker, and returns true if the
+// breaker had opened, so the service has recovered
+func (b *CircuitBreaker) Success() bool {
+	recovered := b.failures >= b.Threshold
+	b.failures = 0
+	b.backoff = 0
+	b.openUntil = time.Time{}
+	return recovered
+}
+
+// records a failed call, and returns true if this opened the breaker. Calls
+// that fail while the breaker is already open were started before it opened,
+// and are not counted.
+func (b *CircuitBreaker) Failure() bool {
+	if !b.Allow() {
+		return false
+	}
+	b.failures++
+	if b.failures < b.Threshold {
+		return false
+	}
+	if b.backoff == 0 {
+		b.backoff = b.Cooldown
+	} else {
+		b.backoff *= 2
+	}
+	if b.MaxCooldown > 0 && b.backoff > b.MaxCooldown {
+		b.backoff = b.MaxCooldown
+	}
+	b.openUntil = time.Now().Add(b.backoff)
+	return true
+}
@@ -0,0 +1,59 @@
+package cloudwatch
+
+import "time"
+
+// with LOGSPOUT_CLOUDWATCH_STREAM_BUCKET, a new stream is written to in each
+// period, so what is kept for each stream is discarded once its bucket has
+// been over for BUCKET_EVICT_DELAY, checked every BUCKET_EVICT_INTERVAL. A
+// late event for it then fetches the stream's token again.
+const BUCKET_EVICT_DELAY = time.Hour
+const BUCKET_EVICT_INTERVAL = 10 * time.Minute
+
+// returns whether a stream is named after a time bucket that has been over
+// for BUCKET_EVICT_DELAY
+func (u *CloudwatchUploader) bucketEnded(stream string, now time.Time) bool {
+	end, isBucket := u.adapter.bucketEnd(stream)
+	return isBucket && now.Sub(end) > BUCKET_EVICT_DELAY
+}
+
+// discards the tokens (saved or passed between adapters), counts, and other
+// state kept for streams whose time buckets are over. Counts are kept until
+// their checkpoint is sent.
+func (u *CloudwatchUploader) evictBuckets(now time.Time) {
+	for id := range u.tokens {
+		if u.bucketEnded(id.Stream, now) {
+			delete(u.tokens, id)
+			u.tokenChanged(id)
+		}
+	}
+	for id, count := range u.counts {
+		if u.bucketEnded(id.Stream, now) && count.delivered == 0 {
+			delete(u.counts, id)
+		}
+	}
+	for id := range u.uploaded {
+		if u.bucketEnded(id.Stream, now) {
+			delete(u.uploaded, id)
+		}
+	}
+	for id := range u.errors {
+		if u.bucketEnded(id.Stream, now) {
+			delete(u.errors, id)
+		}
+	}
+	for id := range u.denied {
+		if u.bucketEnded(id.Stream, now) {
+			delete(u.denied, id)
+		}
+	}
+	for id := range u.conflicts {
+		if u.bucketEnded(id.Stream, now) {
+			delete(u.conflicts, id)
+		}
+	}
+	forgetDestinations(func(key destinationKey) bool {
+		return key.Kind == DESTINATION_STREAM && key.Endpoint == u.endpoint &&
+			key.Region == u.region && u.bucketEnded(key.Stream, now)
+	})
+	u.saveTokens()
+}
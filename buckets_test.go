@@ -0,0 +1,114 @@
+package cloudwatch
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestEventsGoToTheirHourlyBucket(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_STREAM_BUCKET`: `hour`})
+	now := time.Now().UTC()
+	for _, msg := range []CloudwatchMessage{
+		{Message: `now`, Group: `g`, Stream: `s`, Time: now},
+		{Message: `late`, Group: `g`, Stream: `s`, Time: now.Add(-time.Hour)},
+	} {
+		a.batcher.Input <- a.bucket(msg)
+	}
+	current := `s/` + now.Format(`2006-01-02T15`)
+	earlier := `s/` + now.Add(-time.Hour).Format(`2006-01-02T15`)
+	f.await(t, "both buckets", func() bool {
+		return len(f.messages(`g`, current)) == 1 && len(f.messages(`g`, earlier)) == 1
+	})
+}
+
+func TestBucketEnd(t *testing.T) {
+	a := &CloudwatchAdapter{streamBucket: streamBuckets[`day`]}
+	end, isBucket := a.bucketEnd(`my-container/2024-05-01`)
+	if !isBucket || !end.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v, %t, want the end of the day", end, isBucket)
+	}
+	if _, isBucket := a.bucketEnd(`my-container`); isBucket {
+		t.Error("a stream without a bucket has an end")
+	}
+	if _, isBucket := (&CloudwatchAdapter{}).bucketEnd(`s/2024-05-01`); isBucket {
+		t.Error("a bucket has an end with buckets disabled")
+	}
+}
+
+func TestEndedBucketsAreEvicted(t *testing.T) {
+	a := &CloudwatchAdapter{streamBucket: streamBuckets[`hour`]}
+	file := filepath.Join(t.TempDir(), `tokens.json`)
+	u := tokenUploader(file, `us-east-1`)
+	u.adapter, u.endpoint = a, `evict-test`
+	u.counts, u.uploaded = map[streamID]*streamCount{}, map[streamID]time.Time{}
+	u.errors, u.denied = map[streamID]*repeatedError{}, map[streamID]time.Time{}
+	u.conflicts = map[streamID]*conflictCount{}
+	now := time.Date(2024, 5, 1, 13, 30, 0, 0, time.UTC)
+	ended := streamID{Group: `g`, Stream: `s/2024-05-01T11`}
+	unsent := streamID{Group: `g`, Stream: `s/2024-05-01T10`}
+	recent := streamID{Group: `g`, Stream: `s/2024-05-01T12`}
+	for _, id := range []streamID{ended, unsent, recent} {
+		u.tokens[id] = aws.String(`token`)
+		u.tokenChanged(id)
+		u.counts[id] = &streamCount{}
+		u.uploaded[id] = now
+		u.lockStream(id.Role, id.Group, id.Stream).Unlock()
+	}
+	u.counts[unsent].delivered = 1 // its checkpoint hasn't been sent yet
+	u.saveTokens()
+
+	u.evictBuckets(now)
+	for _, id := range []streamID{ended, unsent} {
+		if _, kept := u.tokens[id]; kept {
+			t.Errorf("kept the token of %s", id.Stream)
+		}
+		if _, kept := u.uploaded[id]; kept {
+			t.Errorf("kept the upload time of %s", id.Stream)
+		}
+	}
+	if _, kept := u.counts[ended]; kept {
+		t.Error("kept the count of an ended bucket")
+	}
+	if _, kept := u.counts[unsent]; !kept {
+		t.Error("evicted a count before its checkpoint was sent")
+	}
+	if _, kept := u.tokens[recent]; !kept {
+		t.Error("evicted the token of a bucket that ended within the delay")
+	}
+	if saved, _ := readTokens(file); len(saved) != 1 || saved[0].Stream != recent.Stream {
+		t.Errorf("saved %v, want only the token of %s", saved, recent.Stream)
+	}
+	destinations.Lock()
+	defer destinations.Unlock()
+	for key := range destinations.locks {
+		if key.Endpoint == u.endpoint && key.Stream != recent.Stream {
+			t.Errorf("kept the lock of %s", key.Stream)
+		}
+	}
+}
+
+func TestForgottenLockIsAddedAgain(t *testing.T) {
+	key := destinationKey{Kind: DESTINATION_STREAM, Endpoint: `forget-test`}
+	lock := lockDestination(key)
+	forgotten := make(chan bool)
+	go func() {
+		forgetDestinations(func(k destinationKey) bool { return k == key })
+		close(forgotten)
+	}()
+	locked := make(chan *destinationLock)
+	go func() {
+		<-forgotten
+		locked <- lockDestination(key)
+	}()
+	lock.Unlock()
+	again := <-locked
+	defer again.Unlock()
+	if again == lock || again.forgotten {
+		t.Error("locked a forgotten lock")
+	}
+}
@@ -0,0 +1,80 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// a checkpoint event, written to each log stream every
+// LOGSPOUT_CLOUDWATCH_CHECKPOINT_INTERVAL, so gaps and resets can be
+// detected downstream
+type checkpointEvent struct {
+	Event     string `json:"event"`
+	Delivered int64  `json:"delivered"` // since the last checkpoint
+	Total     int64  `json:"total"`     // since logspout started
+}
+
+// the events delivered to a log stream, for its checkpoints
+type streamCount struct {
+	delivered int64
+	total     int64
+	latest    time.Time // the latest timestamp delivered
+}
+
+// counts the events of a batch that was uploaded, if checkpoints are
+// enabled. Only container events are counted, not checkpoints themselves,
+// nor diagnostic events.
+func (u *CloudwatchUploader) countDelivered(batch CloudwatchBatch) {
+	if u.checkpointInterval <= 0 {
+		return
+	}
+	for _, msg := range batch.Msgs {
+		if msg.Container == "" {
+			continue
+		}
+		count, exists := u.counts[msg.logStream()]
+		if !exists {
+			count = &streamCount{}
+			u.counts[msg.logStream()] = count
+		}
+		count.delivered++
+		count.total++
+		if msg.Time.After(count.latest) {
+			count.latest = msg.Time
+		}
+	}
+}
+
+// uploads a checkpoint event to each log stream that has been delivered
+// events since its last checkpoint. A checkpoint is never timestamped
+// before the events it counts, so it stays in order after them.
+func (u *CloudwatchUploader) sendCheckpoints() {
+	now := time.Now()
+	for stream, count := range u.counts {
+		if count.delivered == 0 {
+			continue
+		}
+		encoded, err := json.Marshal(checkpointEvent{
+			Event:     `checkpoint`,
+			Delivered: count.delivered,
+			Total:     count.total,
+		})
+		if err != nil {
+			continue
+		}
+		timestamp := now
+		if count.latest.After(timestamp) {
+			timestamp = count.latest
+		}
+		count.delivered = 0
+		batch := NewCloudwatchBatch()
+		batch.Append(CloudwatchMessage{
+			Message: string(encoded),
+			Group:   stream.Group,
+			Stream:  stream.Stream,
+			Role:    stream.Role,
+			Time:    timestamp,
+		})
+		u.submit(*batch)
+	}
+}
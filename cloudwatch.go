@@ -1,18 +1,26 @@
 package cloudwatch
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // the logspout image has no time zone database
 
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gliderlabs/logspout/router"
 )
 
 func init() {
 	router.AdapterFactories.Register(NewCloudwatchAdapter, "cloudwatch")
+	router.HttpHandlers.Register(DebugHandler, "cloudwatch")
 }
 
 // CloudwatchAdapter is an adapter that streams JSON to AWS CloudwatchLogs.
@@ -24,16 +32,134 @@ type CloudwatchAdapter struct {
 	OsHost      string
 	Ec2Region   string
 	Ec2Instance string
+	// tags of the EC2 instance, if LOGSPOUT_CLOUDWATCH_INSTANCE_TAGS is set
+	InstanceTags map[string]string
+
+	// the AWS account ID, fetched if the route's templates may render it
+	account            accountCache
+	accountInTemplates bool
 
 	client        *docker.Client
-	batcher       *CloudwatchBatcher // batches up messages by log group and stream
-	groupnames    map[string]string  // maps container names to log groups
-	streamnames   map[string]string  // maps container names to log streams
-	retentiondays map[string]int64   // maps log groups to retention days
+	batcher       *CloudwatchBatcher    // batches up messages by log group and stream
+	cacheKey      string                // container identity used to key the caches
+	groupnames    map[string]string     // maps cache keys to log groups
+	streamnames   map[string]string     // maps cache keys to log streams
+	groupsLock    sync.Mutex            // guards the group settings, read by the uploader
+	retentiondays map[string]int64      // maps log groups to retention days
+	logclasses    map[string]string     // maps log groups to log classes
+	fanouts       map[string][]streamID // maps cache keys to extra destinations
+	prefixes      map[string]string     // maps cache keys to message prefixes
+	attributes    map[string]labelSet   // maps cache keys to JSON event labels
+	stderrgroups  map[string]string     // maps cache keys to stderr log groups
+	splitStderr   bool                  // sends stderr to separate log groups
+
+	recordTerminator string                          // ends records spanning messages
+	recordSeparator  string                          // joins a record's messages
+	recordTimeout    time.Duration                   // sends incomplete records after
+	recordMaxSize    int                             // sends records larger than
+	recordMaxLines   int                             // sends records longer than
+	records          map[recordKey]*CloudwatchRecord // maps outputs to records
+
+	inspectSlots   chan bool       // bounds concurrent container inspections
+	inspectTimeout time.Duration   // limits each container inspection
+	dockerBreaker  *CircuitBreaker // skips inspection while Docker is failing
+
+	groupSanitizer  *NameSanitizer // replaces disallowed characters in groups
+	streamSanitizer *NameSanitizer // and in streams
+	unnamedStreams  string         // how unnamed containers' streams are named
+	hostSource      string         // where the context's Host comes from
+	streamBucket    timeBucket     // the period of stream buckets, if enabled
+	fallbackStream  string         // replaces stream names with nothing valid
+	routing         routingExprs   // compute group and stream names, if set
+
+	admin        bool                           // enables the admin endpoints
+	startBanners bool                           // announces each container's start
+	bannered     map[string]time.Time           // maps container IDs to announced starts
+	lifecycle    map[string]bool                // Docker events written to streams
+	crashLines   int                            // recent lines kept for each container
+	crashBuffers map[string][]CloudwatchMessage // maps cache keys to recent lines
+
+	skipBefore     time.Time       // drops messages logged before this time
+	errorLabelName string          // container label identifying it in errors
+	arrivalOrder   bool            // timestamps messages when they arrive
+	arrivals       uint64          // counts messages, to number them in order
+	jsonFields     []string        // metadata added to JSON events, if enabled
+	jsonLabels     []string        // container labels added to JSON events
+	jsonEnv        []string        // and container environment variables
+	jsonTopLevel   bool            // adds them as fields, not an object
+	bodyTimestamp  string          // layout of the time prepended to events
+	bodyLocation   *time.Location  // and its time zone
+	maxLength      int             // bytes of text kept of each message, if set
+	healthchecks   *regexp.Regexp  // matches health check lines to drop, if set
+	levels         *levelFilter    // drops lines below a minimum level, if set
+	transforms     []transform     // applied to each message's text, in order
+	tee            io.Writer       // messages are also copied here, if set
+	excludeImages  *regexp.Regexp  // matches images whose logs to drop, if set
+	excluded       map[string]bool // maps container IDs to excluded images
+	blankPolicy    string          // whether messages with blank names are dropped
+	blankDropped   int64           // since the last warning about them
+	blankWarned    time.Time       // and when that was
+	stats          *Counters       // counts dropped messages and other events
+}
+
+// Strategies for choosing the container identity that keys the group, stream
+// and sequence token caches, set with LOGSPOUT_CLOUDWATCH_CACHE_KEY.
+const CACHE_KEY_ID = `id`           // the container ID (default)
+const CACHE_KEY_NAME = `name`       // the container name
+const CACHE_KEY_SERVICE = `service` // the compose project, service and slot
+const CACHE_KEY_LABEL = `label:`    // prefix for keying on any container label
+
+// Default stream names for containers without a name, chosen with
+// LOGSPOUT_CLOUDWATCH_UNNAMED_STREAM.
+const UNNAMED_STREAM_SHORT_ID = `short-id` // the first 12 digits of the ID
+const UNNAMED_STREAM_ID = `id`             // the full container ID
+const SHORT_ID_LENGTH = 12
+
+// Sources of the Host in the render context, chosen with
+// LOGSPOUT_CLOUDWATCH_HOST_SOURCE, for when many containers share a hostname.
+const HOST_SOURCE_CONTAINER = `container` // the container's hostname (default)
+const HOST_SOURCE_LOGGER = `logger`       // logspout's own hostname
+const HOST_SOURCE_INSTANCE = `instance`   // the EC2 instance ID
+
+// LOGSPOUT_CLOUDWATCH_ON_BLANK_NAME policies, for messages whose group or
+// stream name is blank
+const BLANK_NAME_DROP = `drop` // drop and count them (default)
+const BLANK_NAME_SEND = `send` // upload them anyway, to be rejected
+
+// Time buckets for LOGSPOUT_CLOUDWATCH_STREAM_BUCKET, which suffixes each
+// stream name with the hour or day of the event's timestamp, in UTC, so each
+// stream holds one period's events. The formats leave out colons, which
+// stream names can't contain.
+var streamBuckets = map[string]timeBucket{
+	`hour`: {Format: `2006-01-02T15`, Period: time.Hour},
+	`day`:  {Format: `2006-01-02`, Period: 24 * time.Hour},
 }
 
+// a period of time that stream names can be suffixed with
+type timeBucket struct {
+	Format string // the layout of the suffix
+	Period time.Duration
+}
+
+// matches common health check requests in access logs, such as
+// "GET /health HTTP/1.1" 200, when LOGSPOUT_CLOUDWATCH_DROP_HEALTHCHECKS is set
+const DEFAULT_HEALTHCHECK_PATTERN = `(?i)\b(GET|HEAD) /(health(z|check)?|ping|readyz?|livez?|status)([/?][^ "]*)?( HTTP/[0-9.]+)?"? (200|204)\b`
+
+const DEFAULT_INSPECT_CONCURRENCY = 4 // containers inspected at once
+
+// with LOGSPOUT_CLOUDWATCH_SPLIT_STDERR, stderr goes to the container's log
+// group name with this suffix, unless LOGSPOUT_CLOUDWATCH_STDERR_GROUP is set
+const DEFAULT_STDERR_SUFFIX = "-stderr"
+
+// with LOGSPOUT_CLOUDWATCH_SKIP_BACKLOG, messages logged up to this long
+// before the adapter started are still sent
+const DEFAULT_BACKLOG_GRACE = 5 * time.Second
+
 // NewCloudwatchAdapter creates a CloudwatchAdapter for the current region.
 func NewCloudwatchAdapter(route *router.Route) (router.LogAdapter, error) {
+	if err := validateOptions(route); err != nil {
+		return nil, err
+	}
 	dockerHost := `unix:///var/run/docker.sock`
 	if envVal := os.Getenv(`DOCKER_HOST`); envVal != "" {
 		dockerHost = envVal
@@ -50,71 +176,710 @@ func NewCloudwatchAdapter(route *router.Route) (router.LogAdapter, error) {
 	if err != nil {
 		return nil, err
 	}
+	cacheKey := routeOption(route, `LOGSPOUT_CLOUDWATCH_CACHE_KEY`, CACHE_KEY_ID)
+	if !validCacheKey(cacheKey) {
+		log.Printf("cloudwatch: WARNING unknown cache key %s, using %s\n",
+			cacheKey, CACHE_KEY_ID)
+		cacheKey = CACHE_KEY_ID
+	}
+	groupSanitizer, err := NewNameSanitizer(
+		routeOption(route, `LOGSPOUT_CLOUDWATCH_GROUP_CHARS`, DEFAULT_GROUP_CHARS),
+		routeOption(route, `LOGSPOUT_CLOUDWATCH_NAME_REPLACEMENT`, DEFAULT_NAME_REPLACEMENT))
+	if err != nil {
+		return nil, err
+	}
+	groupSanitizer.Case = routeOption(route, `LOGSPOUT_CLOUDWATCH_GROUP_CASE`, "")
+	streamSanitizer, err := NewNameSanitizer(
+		routeOption(route, `LOGSPOUT_CLOUDWATCH_STREAM_CHARS`, DEFAULT_STREAM_CHARS),
+		routeOption(route, `LOGSPOUT_CLOUDWATCH_NAME_REPLACEMENT`, DEFAULT_NAME_REPLACEMENT))
+	if err != nil {
+		return nil, err
+	}
+	var healthchecks *regexp.Regexp
+	if _, dropHealthchecks := route.Options[`LOGSPOUT_CLOUDWATCH_DROP_HEALTHCHECKS`]; dropHealthchecks ||
+		os.Getenv(`LOGSPOUT_CLOUDWATCH_DROP_HEALTHCHECKS`) != "" {
+		healthchecks, err = regexp.Compile(routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_HEALTHCHECK_PATTERN`, DEFAULT_HEALTHCHECK_PATTERN))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var skipBefore time.Time // zero unless the backlog is skipped
+	if _, skipBacklog := route.Options[`LOGSPOUT_CLOUDWATCH_SKIP_BACKLOG`]; skipBacklog ||
+		os.Getenv(`LOGSPOUT_CLOUDWATCH_SKIP_BACKLOG`) != "" {
+		skipBefore = time.Now().Add(-routeDurationOption(route,
+			`LOGSPOUT_CLOUDWATCH_BACKLOG_GRACE`, DEFAULT_BACKLOG_GRACE))
+	}
+	var excludeImages *regexp.Regexp
+	if pattern := routeOption(route, `LOGSPOUT_CLOUDWATCH_EXCLUDE_IMAGES`, ""); pattern != "" {
+		excludeImages, err = regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tee, err := newTee(route)
+	if err != nil {
+		return nil, err
+	}
+	routing, err := newRoutingExprs(route)
+	if err != nil {
+		return nil, err
+	}
+	transforms, err := newTransforms(route)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := newLevelFilter(route)
+	if err != nil {
+		return nil, err
+	}
+	lifecycle, err := parseLifecycleEvents(routeOption(route,
+		`LOGSPOUT_CLOUDWATCH_LIFECYCLE_EVENTS`, ""))
+	if err != nil {
+		return nil, err
+	}
+	var jsonFields []string // nil unless events are formatted as JSON
+	if _, jsonEvents := route.Options[`LOGSPOUT_CLOUDWATCH_JSON`]; jsonEvents ||
+		os.Getenv(`LOGSPOUT_CLOUDWATCH_JSON`) != "" {
+		jsonFields, err = parseJSONFields(routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_JSON_FIELDS`, DEFAULT_JSON_FIELDS))
+		if err != nil {
+			return nil, err
+		}
+	}
+	bodyLocation, err := time.LoadLocation(routeOption(route,
+		`LOGSPOUT_CLOUDWATCH_BODY_TIMEZONE`, "UTC"))
+	if err != nil {
+		return nil, err
+	}
+	// static values take precedence over those read from EC2
+	instanceID := routeOption(route, `LOGSPOUT_CLOUDWATCH_INSTANCE_ID`, ec2info.InstanceID)
+	region := routeOption(route, `LOGSPOUT_CLOUDWATCH_REGION`, ec2info.Region)
 	adapter := CloudwatchAdapter{
 		Route:         route,
 		OsHost:        hostname,
-		Ec2Instance:   ec2info.InstanceID,
-		Ec2Region:     ec2info.Region,
+		Ec2Instance:   instanceID,
+		Ec2Region:     region,
 		client:        client,
+		cacheKey:      cacheKey,
 		groupnames:    map[string]string{},
 		streamnames:   map[string]string{},
 		retentiondays: map[string]int64{},
+		logclasses:    map[string]string{},
+		fanouts:       map[string][]streamID{},
+		prefixes:      map[string]string{},
+		attributes:    map[string]labelSet{},
+		stderrgroups:  map[string]string{},
+		splitStderr:   routeFlag(route, `LOGSPOUT_CLOUDWATCH_SPLIT_STDERR`),
+
+		recordTerminator: routeEscapedOption(route,
+			`LOGSPOUT_CLOUDWATCH_RECORD_TERMINATOR`, ""),
+		recordSeparator: routeEscapedOption(route,
+			`LOGSPOUT_CLOUDWATCH_MULTILINE_SEPARATOR`, DEFAULT_RECORD_SEPARATOR),
+		recordTimeout: routeDurationOption(route,
+			`LOGSPOUT_CLOUDWATCH_RECORD_TIMEOUT`, DEFAULT_RECORD_TIMEOUT),
+		recordMaxSize: routeIntOption(route,
+			`LOGSPOUT_CLOUDWATCH_RECORD_MAX_SIZE`, DEFAULT_RECORD_MAX_SIZE),
+		recordMaxLines: routeIntOption(route,
+			`LOGSPOUT_CLOUDWATCH_MULTILINE_MAX_LINES`, 0),
+		records: map[recordKey]*CloudwatchRecord{},
+
+		inspectSlots: make(chan bool, routeIntOption(route,
+			`LOGSPOUT_CLOUDWATCH_INSPECT_CONCURRENCY`, DEFAULT_INSPECT_CONCURRENCY)),
+		inspectTimeout: routeDurationOption(route,
+			`LOGSPOUT_CLOUDWATCH_DOCKER_TIMEOUT`, DEFAULT_DOCKER_TIMEOUT),
+		dockerBreaker: &CircuitBreaker{
+			Threshold: routeIntOption(route,
+				`LOGSPOUT_CLOUDWATCH_DOCKER_FAILURES`, DEFAULT_DOCKER_FAILURES),
+			Cooldown: routeDurationOption(route,
+				`LOGSPOUT_CLOUDWATCH_DOCKER_COOLDOWN`, DEFAULT_DOCKER_COOLDOWN),
+			MaxCooldown: routeDurationOption(route,
+				`LOGSPOUT_CLOUDWATCH_DOCKER_MAX_COOLDOWN`, DEFAULT_DOCKER_MAX_COOLDOWN),
+		},
+
+		groupSanitizer:  groupSanitizer,
+		streamSanitizer: streamSanitizer,
+		unnamedStreams: routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_UNNAMED_STREAM`, UNNAMED_STREAM_SHORT_ID),
+		hostSource: routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_HOST_SOURCE`, HOST_SOURCE_CONTAINER),
+		routing: routing,
+		fallbackStream: streamSanitizer.Sanitize(routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_FALLBACK_STREAM`, "")),
+		streamBucket: streamBuckets[routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_STREAM_BUCKET`, "")],
+
+		admin:        routeFlag(route, `LOGSPOUT_CLOUDWATCH_ADMIN`),
+		startBanners: routeFlag(route, `LOGSPOUT_CLOUDWATCH_START_BANNER`),
+		bannered:     map[string]time.Time{},
+		lifecycle:    lifecycle,
+		crashLines:   routeIntOption(route, `LOGSPOUT_CLOUDWATCH_CRASH_LINES`, 0),
+		crashBuffers: map[string][]CloudwatchMessage{},
+
+		skipBefore:     skipBefore,
+		errorLabelName: routeOption(route, `LOGSPOUT_CLOUDWATCH_ERROR_LABEL`, ""),
+		arrivalOrder:   routeFlag(route, `LOGSPOUT_CLOUDWATCH_ARRIVAL_ORDER`),
+		jsonFields:     jsonFields,
+		jsonLabels:     parseLabelNames(routeOption(route, `LOGSPOUT_CLOUDWATCH_JSON_LABELS`, "")),
+		jsonEnv:        parseLabelNames(routeOption(route, `LOGSPOUT_CLOUDWATCH_JSON_ENV`, "")),
+		jsonTopLevel:   routeFlag(route, `LOGSPOUT_CLOUDWATCH_JSON_TOP_LEVEL`),
+		bodyTimestamp:  routeOption(route, `LOGSPOUT_CLOUDWATCH_BODY_TIMESTAMP`, ""),
+		bodyLocation:   bodyLocation,
+		maxLength:      routeIntOption(route, `LOGSPOUT_CLOUDWATCH_MAX_MESSAGE_LENGTH`, 0),
+		healthchecks:   healthchecks,
+		levels:         levels,
+		transforms:     transforms,
+		tee:            tee,
+		excludeImages:  excludeImages,
+		excluded:       map[string]bool{},
+		blankPolicy:    routeOption(route, `LOGSPOUT_CLOUDWATCH_ON_BLANK_NAME`, BLANK_NAME_DROP),
+		stats:          NewCounters(),
 	}
-	adapter.batcher = NewCloudwatchBatcher(&adapter)
+	adapter.batcher, err = NewCloudwatchBatcher(&adapter)
+	if err != nil {
+		return nil, err
+	}
+	// a static account ID saves asking STS for it
+	if id := routeOption(route, `LOGSPOUT_CLOUDWATCH_ACCOUNT_ID`, ""); id != "" {
+		adapter.account.id, adapter.account.fetched = id, true
+	}
+	adapter.accountInTemplates = routeUsesAccountID(route)
+	adapter.InstanceTags = map[string]string{}
+	if names := routeOption(route, `LOGSPOUT_CLOUDWATCH_INSTANCE_TAGS`, ""); names != "" {
+		adapter.InstanceTags = adapter.batcher.uploader.instanceTags(names)
+	}
+	registerAdapter(&adapter)
 	return &adapter, nil
 }
 
 // Stream implements the router.LogAdapter interface.
+// Containers seen for the first time are inspected in the background, by up
+// to LOGSPOUT_CLOUDWATCH_INSPECT_CONCURRENCY goroutines at once, while their
+// messages wait in order, so new containers never block the others' logs.
 func (a *CloudwatchAdapter) Stream(logstream chan *router.Message) {
-	for m := range logstream {
-		// determine the log group name and log stream name
-		var groupName, streamName string
-		// first, check the in-memory cache so this work is done per-container
-		if cachedGroup, isCached := a.groupnames[m.Container.ID]; isCached {
-			groupName = cachedGroup
-		}
-		if cachedStream, isCached := a.streamnames[m.Container.ID]; isCached {
-			streamName = cachedStream
-		}
-		if (streamName == "") || (groupName == "") {
-			// make a render context with the required info
-			containerData, err := a.client.InspectContainer(m.Container.ID)
-			if err != nil {
-				log.Println("cloudwatch: error inspecting container:", err)
+	var recordTimer <-chan time.Time // only ticks when reassembling records
+	if a.recordTerminator != "" {
+		ticker := time.NewTicker(a.recordTimeout)
+		defer ticker.Stop()
+		recordTimer = ticker.C
+	}
+	pending := map[string][]arrival{} // messages awaiting inspection
+	inspected := make(chan inspection)
+	events := &eventSubscription{} // only delivers with lifecycle events
+	a.subscribe(events)
+	defer a.unsubscribe(events)
+	for {
+		select {
+		case message, open := <-logstream:
+			if !open { // wait for outstanding inspections, then send it all
+				for len(pending) > 0 {
+					result := <-inspected
+					a.resolveMessages(result, pending[result.key])
+					delete(pending, result.key)
+				}
+				a.flushRecords(true)
+				return
+			}
+			m := arrival{Message: a.transform(message), Arrived: time.Now(), Seq: a.arrivals}
+			a.arrivals++
+			if m.Time.Before(a.skipBefore) { // replayed from before startup
+				a.stats.Add(`backlog_dropped`, 1)
 				continue
 			}
-			context := RenderContext{
-				Env:        parseEnv(m.Container.Config.Env),
-				Labels:     containerData.Config.Labels,
-				Name:       strings.TrimPrefix(m.Container.Name, `/`),
-				ID:         m.Container.ID,
-				Host:       m.Container.Config.Hostname,
-				LoggerHost: a.OsHost,
-				InstanceID: a.Ec2Instance,
-				Region:     a.Ec2Region,
+			if a.healthchecks != nil && a.healthchecks.MatchString(m.Data) {
+				a.stats.Add(`healthchecks_dropped`, 1)
+				continue
 			}
-			groupName = a.renderEnvValue(`LOGSPOUT_GROUP`, &context, a.OsHost)
-			streamName = a.renderEnvValue(`LOGSPOUT_STREAM`, &context, context.Name)
-			a.groupnames[m.Container.ID] = groupName   // cache the group name
-			a.streamnames[m.Container.ID] = streamName // and the stream name
-
-			retentionDays := a.renderEnvValue(`LOGSPOUT_CLOUDWATCH_RETENTION_DAYS`, &context, "")
-
-			if (retentionDays != "") {
-				retentionDaysInt, err := strconv.ParseInt(retentionDays, 10, 64)
-				if err == nil {
-					a.retentiondays[groupName] = retentionDaysInt
-				} else {
-					log.Printf("cloudwatch: error parsing retention days of '%s' to a int64: %s", retentionDays, err)
+			if a.excludedImage(m.Container) {
+				a.stats.Add(`image_dropped`, 1)
+				continue
+			}
+			if a.levels != nil && !a.levels.keep(m.Data) {
+				a.stats.Add(`level_dropped`, 1)
+				continue
+			}
+			key := a.containerKey(m.Container)
+			if waiting, isPending := pending[key]; isPending {
+				pending[key] = append(waiting, m) // keep the container's order
+				continue
+			}
+			_, groupCached := a.groupnames[key]
+			_, streamCached := a.streamnames[key]
+			if groupCached && streamCached {
+				a.send(m, key)
+				continue
+			}
+			if !a.dockerBreaker.Allow() { // use the container data logspout sent
+				a.resolve(m.Message, key, m.Container)
+				a.sendBanner(key, m.Container)
+				a.send(m, key)
+				if transitional(m.Container) {
+					a.forget(key)
 				}
+				continue
+			}
+			pending[key] = []arrival{m}
+			go a.inspect(m.Container.ID, key, inspected)
+		case result := <-inspected:
+			a.resolveMessages(result, pending[result.key])
+			delete(pending, result.key)
+		case <-recordTimer: // send any records that have waited too long
+			a.flushRecords(false)
+		case event, open := <-events.events:
+			if !open { // the Docker client stopped listening
+				events.retryLater()
+				log.Println("cloudwatch: WARNING lost Docker events, subscribing again in",
+					events.delay)
+				continue
 			}
+			events.received()
+			a.sendLifecycle(event)
+			a.replayCrash(event)
+			a.forgetBanner(event)
+		case <-events.retry:
+			a.subscribe(events)
+		}
+	}
+}
+
+// a message as it arrived from logspout, numbered in order of arrival
+type arrival struct {
+	*router.Message
+	Arrived time.Time
+	Seq     uint64
+}
+
+// the result of inspecting a container in the background
+type inspection struct {
+	key           string
+	containerData *docker.Container
+	err           error
+}
+
+// inspects the container with the given ID, waiting for one of the slots
+// that bound concurrent inspections, and sends the result on results.
+func (a *CloudwatchAdapter) inspect(id, key string, results chan inspection) {
+	a.inspectSlots <- true
+	ctx, cancel := context.WithTimeout(context.Background(), a.inspectTimeout)
+	containerData, err := a.client.InspectContainerWithContext(id, ctx)
+	cancel()
+	<-a.inspectSlots
+	results <- inspection{key: key, containerData: containerData, err: err}
+}
+
+// caches the group and stream names for an inspected container, then sends
+// the messages that were waiting for it. If inspection failed, the container
+// data that logspout sent with the first message is used instead, so none of
+// the messages are lost, and they are counted as inspect_fallback_messages.
+func (a *CloudwatchAdapter) resolveMessages(result inspection,
+	messages []arrival) {
+	containerData := result.containerData
+	if result.err != nil {
+		log.Printf("cloudwatch: error inspecting container, routing %d messages "+
+			"with the container data logspout sent: %s\n", len(messages), result.err)
+		a.stats.Add(`inspect_fallback_messages`, int64(len(messages)))
+		if a.dockerBreaker.Failure() {
+			log.Printf("cloudwatch: WARNING Docker API failing, skipping container inspection for %s\n",
+				time.Until(a.dockerBreaker.OpenUntil()).Round(time.Second))
+		}
+		containerData = messages[0].Container
+	} else if a.dockerBreaker.Success() {
+		log.Println("cloudwatch: Docker API recovered, inspecting containers again")
+	}
+	a.resolve(messages[0].Message, result.key, containerData)
+	a.sendBanner(result.key, containerData)
+	for _, m := range messages {
+		a.send(m, result.key)
+	}
+	if transitional(containerData) {
+		a.forget(result.key)
+	}
+}
+
+// computes the log group, log stream and other per-container settings for
+// the container that sent the given message, and caches them under key.
+func (a *CloudwatchAdapter) resolve(m *router.Message, key string,
+	containerData *docker.Container) {
+	// make a render context with the required info
+	env := parseEnv(m.Container.Config.Env)
+	context := RenderContext{
+		Env:          env,
+		Labels:       containerData.Config.Labels,
+		Name:         strings.TrimPrefix(m.Container.Name, `/`),
+		ID:           m.Container.ID,
+		Host:         a.contextHost(m.Container),
+		LoggerHost:   a.OsHost,
+		InstanceID:   a.Ec2Instance,
+		Region:       a.Ec2Region,
+		AccountID:    a.contextAccountID(env),
+		InstanceTags: a.InstanceTags,
+		Tag:          dockerTag(containerData),
+		Command:      containerCommand(containerData),
+	}
+	context.setKubernetesFields()
+	groupName := a.groupSanitizer.Sanitize(evalRoutingExpr(a.routing.group,
+		&context, a.renderEnvValue(`LOGSPOUT_GROUP`, &context, a.OsHost)))
+	defaultStream := context.Name
+	if defaultStream == "" { // some short-lived containers have no name
+		defaultStream = a.unnamedStream(context.ID)
+	}
+	streamName := a.streamSanitizer.Sanitize(evalRoutingExpr(a.routing.stream,
+		&context, a.renderEnvValue(`LOGSPOUT_STREAM`, &context, defaultStream)))
+	if a.streamSanitizer.Blank(streamName) && a.fallbackStream != "" {
+		log.Printf("cloudwatch: WARNING stream name %q for %s is invalid, using %s\n",
+			streamName, context.Name, a.fallbackStream)
+		streamName = a.fallbackStream
+	}
+	a.groupnames[key] = groupName   // cache the group name
+	a.streamnames[key] = streamName // and the stream name
+
+	retentionDays := a.renderEnvValue(`LOGSPOUT_CLOUDWATCH_RETENTION_DAYS`, &context, "")
+	a.setRetentionDays(groupName, retentionDays)
+
+	logClass := a.renderEnvValue(`LOGSPOUT_CLOUDWATCH_LOG_CLASS`, &context, "")
+	a.setLogClass(groupName, logClass)
+
+	// stderr may go to its own group, so it can be kept for longer
+	delete(a.stderrgroups, key)
+	if a.splitStderr {
+		stderrGroup := a.groupSanitizer.Sanitize(a.renderEnvValue(
+			`LOGSPOUT_CLOUDWATCH_STDERR_GROUP`, &context, groupName+DEFAULT_STDERR_SUFFIX))
+		a.stderrgroups[key] = stderrGroup
+		a.setRetentionDays(stderrGroup, a.renderEnvValue(
+			`LOGSPOUT_CLOUDWATCH_STDERR_RETENTION_DAYS`, &context, retentionDays))
+		a.setLogClass(stderrGroup, logClass)
+	}
+
+	fanout := a.renderEnvValue(`LOGSPOUT_CLOUDWATCH_FANOUT`, &context, "")
+	a.fanouts[key] = a.parseFanout(fanout, streamName)
+
+	a.prefixes[key] = a.renderEnvValue(`LOGSPOUT_CLOUDWATCH_PREFIX`, &context, "")
+	a.attributes[key] = a.labelAttributes(containerData)
+}
+
+// caches the retention policy for a log group, if one is given
+func (a *CloudwatchAdapter) setRetentionDays(group, retentionDays string) {
+	if retentionDays == "" {
+		return
+	}
+	retentionDaysInt, err := strconv.ParseInt(retentionDays, 10, 64)
+	if err == nil {
+		a.groupsLock.Lock()
+		a.retentiondays[group] = retentionDaysInt
+		a.groupsLock.Unlock()
+	} else {
+		log.Printf("cloudwatch: error parsing retention days of '%s' to a int64: %s", retentionDays, err)
+	}
+}
+
+// returns the retention policy and log class cached for a log group, from
+// any goroutine, and whether each is set
+func (a *CloudwatchAdapter) groupSettings(group string) (int64, bool, string, bool) {
+	a.groupsLock.Lock()
+	defer a.groupsLock.Unlock()
+	retentionDays, hasRetention := a.retentiondays[group]
+	logClass, hasClass := a.logclasses[group]
+	return retentionDays, hasRetention, logClass, hasClass
+}
+
+// caches the log class for a log group, if a valid one is given
+func (a *CloudwatchAdapter) setLogClass(group, logClass string) {
+	if logClass == "" {
+		return
+	}
+	if validLogClass(logClass) {
+		a.groupsLock.Lock()
+		a.logclasses[group] = logClass
+		a.groupsLock.Unlock()
+	} else {
+		log.Printf("cloudwatch: invalid log class '%s' for group %s, must be one of %s",
+			logClass, group, strings.Join(cloudwatchlogs.LogGroupClass_Values(), `, `))
+	}
+}
+
+// sends a message from a resolved container on to the batcher, or to its
+// pending record when records are being reassembled. Messages are stamped
+// with the time they are sent, or in arrival order mode, when they arrived,
+// so messages that waited for their container to be inspected keep their
+// place in a shared log stream.
+func (a *CloudwatchAdapter) send(m arrival, key string) {
+	timestamp := time.Now()
+	if a.arrivalOrder {
+		timestamp = m.Arrived
+	}
+	group := a.groupnames[key]
+	if stderrGroup, isSplit := a.stderrgroups[key]; isSplit && m.Source == `stderr` {
+		group = stderrGroup
+	}
+	msg := CloudwatchMessage{
+		Message:   m.Data,
+		Group:     group,
+		Stream:    a.streamnames[key],
+		Time:      timestamp,
+		Container: key,
+		Seq:       m.Seq,
+		Arrived:   m.Arrived,
+		Output:    m.Source,
+
+		ContainerName: strings.TrimPrefix(m.Container.Name, `/`),
+		ContainerID:   m.Container.ID,
+		Label:         a.errorLabel(m.Container),
+		Attributes:    a.attributes[key],
+	}
+	prefix := a.prefixes[key]
+	if a.recordTerminator != "" { // prefixed once, when the record is sent
+		a.bufferCrashLine(msg.prefixed(prefix))
+		a.appendRecord(msg, prefix)
+	} else {
+		msg = msg.prefixed(prefix)
+		a.bufferCrashLine(msg)
+		a.deliver(msg)
+	}
+}
+
+// returns the LOGSPOUT_CLOUDWATCH_ERROR_LABEL label of the container, as
+// "name=value", or an empty string if unset.
+func (a *CloudwatchAdapter) errorLabel(containerData *docker.Container) string {
+	if a.errorLabelName == "" || containerData.Config == nil {
+		return ""
+	}
+	value, exists := containerData.Config.Labels[a.errorLabelName]
+	if !exists {
+		return ""
+	}
+	return a.errorLabelName + "=" + value
+}
+
+// sends a synthetic event marking the start of a newly resolved container
+// to its streams, ahead of its first real message, if banners are enabled.
+// Each start of a container is only announced once.
+func (a *CloudwatchAdapter) sendBanner(key string, containerData *docker.Container) {
+	if !a.startBanners {
+		return
+	}
+	started := containerData.State.StartedAt
+	if announced, exists := a.bannered[containerData.ID]; exists &&
+		announced.Equal(started) {
+		return
+	}
+	a.bannered[containerData.ID] = started
+	image := ""
+	if containerData.Config != nil {
+		image = containerData.Config.Image
+	}
+	a.deliver(CloudwatchMessage{
+		Message: fmt.Sprintf("logspout: container %s (%s) started from image %s at %s",
+			strings.TrimPrefix(containerData.Name, `/`), containerData.ID,
+			image, started.Format(time.RFC3339)),
+		Group:     a.groupnames[key],
+		Stream:    a.streamnames[key],
+		Time:      time.Now(),
+		Container: key,
+
+		ContainerName: strings.TrimPrefix(containerData.Name, `/`),
+		ContainerID:   containerData.ID,
+		Label:         a.errorLabel(containerData),
+		Attributes:    a.attributes[key],
+	})
+}
+
+// sends a message on to the batcher, along with a copy for each of its
+// container's fan-out destinations, which are then batched independently.
+func (a *CloudwatchAdapter) deliver(msg CloudwatchMessage) {
+	a.copyToTee(a.bucket(msg))
+	a.batch(a.bucket(msg))
+	for _, destination := range a.fanouts[msg.Container] {
+		duplicate := msg
+		duplicate.Group, duplicate.Stream = destination.Group, destination.Stream
+		duplicate.Role = destination.Role
+		a.batch(a.bucket(duplicate))
+	}
+}
+
+// sends a message on to the batcher - unless its group or stream name is
+// still blank after every default and fallback, and such messages are
+// dropped, since Cloudwatch would reject them. Drops are counted, and
+// warned of at most once per ERROR_SUMMARY_INTERVAL.
+func (a *CloudwatchAdapter) batch(msg CloudwatchMessage) {
+	if (msg.Group != "" && msg.Stream != "") || a.blankPolicy != BLANK_NAME_DROP {
+		a.batcher.Input <- a.format(msg)
+		return
+	}
+	a.stats.Add(`blank_name_dropped`, 1)
+	a.blankDropped++
+	if time.Since(a.blankWarned) < ERROR_SUMMARY_INTERVAL {
+		return
+	}
+	log.Printf("cloudwatch: WARNING dropped %d messages with a blank log group "+
+		"or stream name, most recently from %s (group %q, stream %q)\n",
+		a.blankDropped, msg.source(), msg.Group, msg.Stream)
+	a.blankDropped = 0
+	a.blankWarned = time.Now()
+}
+
+// returns the message with its stream name suffixed by the time bucket its
+// timestamp falls in, if stream buckets are enabled. Late messages go to the
+// bucket of their own time, so to a stream for an earlier period.
+func (a *CloudwatchAdapter) bucket(msg CloudwatchMessage) CloudwatchMessage {
+	if a.streamBucket.Format != "" {
+		msg.Stream = a.streamSanitizer.Sanitize(
+			msg.Stream + `/` + msg.Time.UTC().Format(a.streamBucket.Format))
+	}
+	return msg
+}
+
+// returns when the time bucket a stream is named after ends, if stream
+// buckets are enabled, and the stream's name ends in one
+func (a *CloudwatchAdapter) bucketEnd(stream string) (time.Time, bool) {
+	length := len(a.streamBucket.Format)
+	if length == 0 || len(stream) < length {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(a.streamBucket.Format, stream[len(stream)-length:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start.Add(a.streamBucket.Period), true
+}
+
+// HELPER METHODS
+
+// returns whether the container's image matches the excluded images, if
+// set. The decision is cached by container ID, until the container is seen
+// restarting or being removed.
+func (a *CloudwatchAdapter) excludedImage(container *docker.Container) bool {
+	if a.excludeImages == nil {
+		return false
+	}
+	excluded, cached := a.excluded[container.ID]
+	if !cached && container.Config != nil {
+		excluded = a.excludeImages.MatchString(container.Config.Image)
+		a.excluded[container.ID] = excluded
+	}
+	if transitional(container) {
+		delete(a.excluded, container.ID)
+	}
+	return excluded
+}
+
+// returns the Host for a container's render context, from the configured
+// source. The instance ID falls back to logspout's hostname outside EC2.
+func (a *CloudwatchAdapter) contextHost(container *docker.Container) string {
+	switch a.hostSource {
+	case HOST_SOURCE_LOGGER:
+		return a.OsHost
+	case HOST_SOURCE_INSTANCE:
+		if a.Ec2Instance != "" {
+			return a.Ec2Instance
 		}
-		a.batcher.Input <- CloudwatchMessage{
-			Message:   m.Data,
-			Group:     groupName,
-			Stream:    streamName,
-			Time:      time.Now(),
-			Container: m.Container.ID,
+		return a.OsHost
+	}
+	return container.Config.Hostname
+}
+
+// returns the identity of the given container used to key the adapter's
+// caches, according to the configured cache key strategy. Falls back to
+// the container ID when the chosen identity is not available.
+func (a *CloudwatchAdapter) containerKey(container *docker.Container) string {
+	var labels map[string]string
+	if container.Config != nil {
+		labels = container.Config.Labels
+	}
+	switch {
+	case a.cacheKey == CACHE_KEY_NAME:
+		if name := strings.TrimPrefix(container.Name, `/`); name != "" {
+			return name
 		}
+	case a.cacheKey == CACHE_KEY_SERVICE:
+		if service := labels[`com.docker.compose.service`]; service != "" {
+			return strings.Join([]string{
+				labels[`com.docker.compose.project`],
+				service,
+				labels[`com.docker.compose.container-number`],
+			}, `/`)
+		}
+	case strings.HasPrefix(a.cacheKey, CACHE_KEY_LABEL):
+		label := strings.TrimPrefix(a.cacheKey, CACHE_KEY_LABEL)
+		if value := labels[label]; value != "" {
+			return value
+		}
+	}
+	return container.ID
+}
+
+// returns whether a container is changing state (restarting, paused, dying
+// or being removed), when its inspection data may not be reliable enough to
+// cache for the rest of its life.
+func transitional(container *docker.Container) bool {
+	state := container.State
+	return state.Restarting || state.Paused || state.Dead ||
+		state.RemovalInProgress
+}
+
+// removes a container's cached names, so that its next message resolves
+// them again
+func (a *CloudwatchAdapter) forget(key string) {
+	delete(a.groupnames, key)
+	delete(a.streamnames, key)
+	delete(a.fanouts, key)
+	delete(a.prefixes, key)
+	delete(a.attributes, key)
+	delete(a.stderrgroups, key)
+	delete(a.crashBuffers, key)
+}
+
+// returns the default stream name for a container that has no name
+func (a *CloudwatchAdapter) unnamedStream(id string) string {
+	if a.unnamedStreams == UNNAMED_STREAM_SHORT_ID && len(id) > SHORT_ID_LENGTH {
+		return id[:SHORT_ID_LENGTH]
+	}
+	return id
+}
+
+// parses a comma-separated list of extra destinations, each either a group
+// name or a group:stream pair. A destination without a stream name uses the
+// container's own stream name within the other group. Any destination may
+// end with @ and the ARN of an IAM role to assume when writing to it.
+func (a *CloudwatchAdapter) parseFanout(fanout,
+	defaultStream string) []streamID {
+	destinations := []streamID{}
+	for _, destination := range strings.Split(fanout, `,`) {
+		destination = strings.TrimSpace(destination)
+		if destination == "" {
+			continue
+		}
+		role := ""
+		if index := strings.Index(destination, `@arn:`); index >= 0 {
+			destination, role = destination[:index], destination[index+1:]
+		}
+		fields := strings.SplitN(destination, `:`, 2)
+		stream := defaultStream
+		if len(fields) > 1 && fields[1] != "" {
+			stream = fields[1]
+		}
+		destinations = append(destinations, streamID{
+			Group:  a.groupSanitizer.Sanitize(fields[0]),
+			Stream: a.streamSanitizer.Sanitize(stream),
+			Role:   role,
+		})
+	}
+	return destinations
+}
+
+func validLogClass(logClass string) bool {
+	for _, validClass := range cloudwatchlogs.LogGroupClass_Values() {
+		if logClass == validClass {
+			return true
+		}
+	}
+	return false
+}
+
+func validCacheKey(cacheKey string) bool {
+	switch cacheKey {
+	case CACHE_KEY_ID, CACHE_KEY_NAME, CACHE_KEY_SERVICE:
+		return true
 	}
+	return strings.HasPrefix(cacheKey, CACHE_KEY_LABEL) &&
+		len(cacheKey) > len(CACHE_KEY_LABEL)
 }
@@ -0,0 +1,197 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// returns a container of a compose service, in the given slot
+func composeContainer(id, slot string) *docker.Container {
+	return &docker.Container{ID: id, Name: `/app_web_` + slot,
+		Config: &docker.Config{Labels: map[string]string{
+			`com.docker.compose.project`:          `app`,
+			`com.docker.compose.service`:          `web`,
+			`com.docker.compose.container-number`: slot,
+		}}}
+}
+
+func TestContainerKeyGroupsByService(t *testing.T) {
+	first, replaced, other := composeContainer(`aaa`, `1`),
+		composeContainer(`bbb`, `1`), composeContainer(`ccc`, `2`)
+	a := &CloudwatchAdapter{cacheKey: CACHE_KEY_ID}
+	if a.containerKey(first) == a.containerKey(replaced) {
+		t.Error("containers with different IDs share a key by default")
+	}
+	a.cacheKey = CACHE_KEY_SERVICE
+	if key := a.containerKey(first); key != `app/web/1` {
+		t.Errorf("service key is %q, want app/web/1", key)
+	}
+	if a.containerKey(first) != a.containerKey(replaced) {
+		t.Error("a replaced container in the same slot has a different key")
+	}
+	if a.containerKey(first) == a.containerKey(other) {
+		t.Error("containers in different slots share a key")
+	}
+	unlabelled := &docker.Container{ID: `ddd`, Config: &docker.Config{}}
+	if key := a.containerKey(unlabelled); key != `ddd` {
+		t.Errorf("key of a container outside compose is %q, want its ID", key)
+	}
+}
+
+func TestParseFanout(t *testing.T) {
+	groups, _ := NewNameSanitizer(DEFAULT_GROUP_CHARS, DEFAULT_NAME_REPLACEMENT)
+	streams, _ := NewNameSanitizer(DEFAULT_STREAM_CHARS, DEFAULT_NAME_REPLACEMENT)
+	a := &CloudwatchAdapter{groupSanitizer: groups, streamSanitizer: streams}
+	const role = `arn:aws:iam::123456789012:role/LogWriter`
+	got := a.parseFanout(` central , audit:app-web, ,shared:web@`+role+`, bad group:a*b`, `web`)
+	want := []streamID{
+		{Group: `central`, Stream: `web`},
+		{Group: `audit`, Stream: `app-web`},
+		{Group: `shared`, Stream: `web`, Role: role},
+		{Group: `bad_group`, Stream: `a_b`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := a.parseFanout(``, `web`); len(got) != 0 {
+		t.Errorf("got %+v for no fan-out, want none", got)
+	}
+}
+
+func TestDeliverFansOut(t *testing.T) {
+	a := &CloudwatchAdapter{
+		batcher: &CloudwatchBatcher{Input: make(chan CloudwatchMessage, 3)},
+		fanouts: map[string][]streamID{`key`: {{Group: `central`, Stream: `web`}}},
+	}
+	a.deliver(CloudwatchMessage{Message: `hello`, Group: `team`, Stream: `web`,
+		Container: `key`})
+	close(a.batcher.Input)
+	streams := map[string]string{}
+	for msg := range a.batcher.Input {
+		streams[msg.Group+`/`+msg.Stream] = msg.Message
+	}
+	want := map[string]string{`team/web`: `hello`, `central/web`: `hello`}
+	if !reflect.DeepEqual(streams, want) {
+		t.Errorf("got events %v, want %v", streams, want)
+	}
+}
+
+// starts a fake Docker daemon for the adapter to inspect containers with,
+// which is stopped when the test ends. inspect returns each container's
+// details, or nil to fail the inspection.
+func newFakeDocker(t *testing.T, inspect func(id string) *docker.Container) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, `/containers/`), `/json`)
+		if id == r.URL.Path {
+			return // such as /events, which ends at once
+		}
+		if container := inspect(id); container != nil {
+			json.NewEncoder(w).Encode(container)
+		} else {
+			http.Error(w, `daemon failing`, http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+	t.Setenv(`DOCKER_HOST`, daemon.URL)
+}
+
+// returns a message logged by the container with the given ID, which is
+// also its name
+func containerLine(id, text string) *router.Message {
+	return &router.Message{Data: text, Source: `stdout`, Time: time.Now(),
+		Container: &docker.Container{ID: id, Name: `/` + id, Config: &docker.Config{}}}
+}
+
+func TestContainersAreInspectedConcurrentlyInOrder(t *testing.T) {
+	inspecting, most := int32(0), int32(0)
+	newFakeDocker(t, func(id string) *docker.Container {
+		now := atomic.AddInt32(&inspecting, 1)
+		defer atomic.AddInt32(&inspecting, -1)
+		for seen := atomic.LoadInt32(&most); now > seen; seen = atomic.LoadInt32(&most) {
+			atomic.CompareAndSwapInt32(&most, seen, now)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if id == `broken` {
+			return nil
+		}
+		return &docker.Container{ID: id, Name: `/` + id, Config: &docker.Config{}}
+	})
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`, `LOGSPOUT_GROUP`: `g`})
+	logstream := make(chan *router.Message)
+	defer close(logstream)
+	go a.Stream(logstream)
+	containers := []string{`one`, `two`, `three`, `broken`}
+	for i := 0; i < 3; i++ {
+		for _, id := range containers {
+			logstream <- containerLine(id, fmt.Sprintf("%s %d", id, i))
+		}
+	}
+	f.await(t, "every container's lines", func() bool {
+		for _, id := range containers {
+			if len(f.messages(`g`, id)) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	for _, id := range containers {
+		want := []string{id + ` 0`, id + ` 1`, id + ` 2`}
+		if got := f.messages(`g`, id); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if atomic.LoadInt32(&most) < 2 {
+		t.Error("containers were inspected one at a time")
+	}
+	if count := a.stats.Snapshot()[`inspect_fallback_messages`]; count != 3 {
+		t.Errorf("counted %d fallback messages, want the 3 of the broken container", count)
+	}
+}
+
+func TestFailingDockerTripsBreaker(t *testing.T) {
+	inspections := map[string]int{}
+	var lock sync.Mutex
+	newFakeDocker(t, func(id string) *docker.Container {
+		lock.Lock()
+		defer lock.Unlock()
+		inspections[id]++
+		if id != `cached` { // the daemon fails after the first container
+			return nil
+		}
+		return &docker.Container{ID: id, Name: `/` + id, Config: &docker.Config{}}
+	})
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`, `LOGSPOUT_GROUP`: `g`,
+		`LOGSPOUT_CLOUDWATCH_DOCKER_FAILURES`: `2`})
+	logstream := make(chan *router.Message)
+	defer close(logstream)
+	go a.Stream(logstream)
+	logstream <- containerLine(`cached`, `cached 0`)
+	f.await(t, "the cached container", func() bool { return len(f.messages(`g`, `cached`)) == 1 })
+	for _, id := range []string{`first`, `second`} { // trip the breaker
+		logstream <- containerLine(id, id)
+		f.await(t, id, func() bool { return len(f.messages(`g`, id)) == 1 })
+	}
+	logstream <- containerLine(`skipped`, `skipped`)
+	logstream <- containerLine(`cached`, `cached 1`)
+	f.await(t, "messages while the breaker is open", func() bool {
+		return len(f.messages(`g`, `skipped`)) == 1 && len(f.messages(`g`, `cached`)) == 2
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if inspections[`skipped`] != 0 || inspections[`cached`] != 1 {
+		t.Errorf("inspected %v, want no inspections while the breaker is open", inspections)
+	}
+}
@@ -0,0 +1,74 @@
+package cloudwatch
+
+import (
+	"log"
+	"time"
+)
+
+// token conflicts on a stream are counted over this long, when
+// LOGSPOUT_CLOUDWATCH_SPLIT_ON_CONFLICTS is set
+const CONFLICT_WINDOW = time.Minute
+
+// the error codes that mean another writer used a stream's sequence token.
+// DataAlreadyAcceptedException isn't one of them: the batch was stored, so
+// it must not be sent again.
+var conflictCodes = map[string]bool{
+	`InvalidSequenceTokenException`: true,
+}
+
+// the token conflicts counted for a stream in the current window
+type conflictCount struct {
+	count   int
+	started time.Time
+}
+
+// returns the batch, moved to the stream that its stream was split into, if
+// it was split. The batch's messages are owned by the uploader by now, so
+// they are renamed in place.
+func (u *CloudwatchUploader) splitBatch(batch CloudwatchBatch) CloudwatchBatch {
+	split, isSplit := u.splits[batch.Msgs[0].logStream()]
+	if !isSplit {
+		return batch
+	}
+	for i := range batch.Msgs {
+		batch.Msgs[i].Stream = split
+	}
+	return batch
+}
+
+// counts a failed upload to a stream, if it failed because another writer
+// is using the same stream. A stream with too many conflicts in a window is
+// split: its later batches go to a stream named after it and this host, so
+// this adapter stops competing for its sequence token.
+func (u *CloudwatchUploader) countConflict(msg CloudwatchMessage, err error) {
+	if u.splitAfter <= 0 || !conflictCodes[errorCode(err)] {
+		return
+	}
+	id := msg.logStream()
+	if u.splitStreams[id] {
+		return // already split, so not shared with other hosts
+	}
+	now := time.Now()
+	conflicts, exists := u.conflicts[id]
+	if !exists || now.Sub(conflicts.started) > CONFLICT_WINDOW {
+		conflicts = &conflictCount{started: now}
+		u.conflicts[id] = conflicts
+	}
+	conflicts.count++
+	if conflicts.count < u.splitAfter {
+		return
+	}
+	delete(u.conflicts, id)
+	split := u.adapter.streamSanitizer.Sanitize(msg.Stream + "-" + u.adapter.OsHost)
+	if split == msg.Stream {
+		return
+	}
+	log.Printf("cloudwatch: WARNING %d token conflicts on %s-%s in %s, "+
+		"so it is shared with another writer - writing to %s-%s instead\n",
+		u.splitAfter, msg.Group, msg.Stream, CONFLICT_WINDOW, msg.Group, split)
+	u.adapter.stats.Add(`streams_split`, 1)
+	u.splits[id] = split
+	splitID := id
+	splitID.Stream = split
+	u.splitStreams[splitID] = true
+}
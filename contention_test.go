@@ -0,0 +1,33 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamIsSplitOnConflicts(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	// each upload is retried once with a fresh token, and conflicts again
+	f.failures[`PutLogEvents`] = []string{`InvalidSequenceTokenException`,
+		`InvalidSequenceTokenException`, `InvalidSequenceTokenException`,
+		`InvalidSequenceTokenException`}
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_SPLIT_ON_CONFLICTS`: `2`})
+	for uploads := 2; uploads <= 4; uploads += 2 {
+		a.batcher.Input <- CloudwatchMessage{Message: `contended`, Group: `g`,
+			Stream: `s`, Time: time.Now()}
+		f.await(t, "the upload and its retry", func() bool {
+			return f.count(`PutLogEvents`) == uploads
+		})
+	}
+	f.await(t, "the stream to be split", func() bool {
+		return a.stats.Snapshot()[`streams_split`] == 1
+	})
+	a.batcher.Input <- CloudwatchMessage{Message: `moved`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	split := a.streamSanitizer.Sanitize(`s-` + a.OsHost)
+	f.await(t, "the split stream", func() bool { return len(f.messages(`g`, split)) == 1 })
+	if messages := f.messages(`g`, `s`); len(messages) != 0 {
+		t.Errorf("uploaded %v to the contended stream", messages)
+	}
+}
@@ -0,0 +1,135 @@
+package cloudwatch
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// LOGSPOUT_CLOUDWATCH_ALREADY_EXISTS policies, for a group or stream that
+// was created by someone else between being looked up and being created
+const ALREADY_EXISTS_IGNORE = "ignore" // carry on, as if it had been created
+const ALREADY_EXISTS_ERROR = "error"   // fail the batch, as any other error
+
+// the kinds of destination that are locked
+const DESTINATION_GROUP = "group"
+const DESTINATION_STREAM = "stream"
+
+// the log groups and streams in use by every adapter in this process, so
+// that adapters sharing a group or stream take turns creating it and
+// uploading to it, and pass its latest sequence token on to each other.
+var destinations = struct {
+	sync.Mutex
+	locks map[destinationKey]*destinationLock
+}{locks: map[destinationKey]*destinationLock{}}
+
+// identifies a log group or stream. Destinations are told apart by where
+// they are (the endpoint, or region) and by the role they are written as,
+// since the same names may refer to different groups in different accounts.
+// A group's key has a blank stream, but is still distinct from the key of a
+// stream with a blank name, by its kind.
+type destinationKey struct {
+	Kind     string // DESTINATION_GROUP or DESTINATION_STREAM
+	Endpoint string
+	Region   string
+	Role     string
+	Group    string
+	Stream   string
+}
+
+// a lock on a log group or stream, shared by every adapter using it
+type destinationLock struct {
+	sync.Mutex
+	token     *string // the token from the latest upload by any adapter
+	written   bool    // whether token is set, as a nil token is meaningful
+	forgotten bool    // whether it was removed, so must be looked up again
+}
+
+// locks, and returns, the lock for a log group. A group lock is never taken
+// while holding a stream lock, so the two can't deadlock.
+func (u *CloudwatchUploader) lockGroup(role, group string) *destinationLock {
+	return lockDestination(destinationKey{Kind: DESTINATION_GROUP,
+		Endpoint: u.endpoint, Region: u.region, Role: role, Group: group})
+}
+
+// locks, and returns, the lock for a log stream
+func (u *CloudwatchUploader) lockStream(role, group, stream string) *destinationLock {
+	return lockDestination(destinationKey{Kind: DESTINATION_STREAM,
+		Endpoint: u.endpoint, Region: u.region, Role: role, Group: group,
+		Stream: stream})
+}
+
+// locks, and returns, the lock for a destination, adding it if it is new
+func lockDestination(key destinationKey) *destinationLock {
+	for {
+		destinations.Lock()
+		lock, exists := destinations.locks[key]
+		if !exists {
+			lock = &destinationLock{}
+			destinations.locks[key] = lock
+		}
+		destinations.Unlock()
+		lock.Lock()
+		if !lock.forgotten {
+			return lock
+		}
+		lock.Unlock() // forgotten while waiting for it, so add it again
+	}
+}
+
+// forgets the locks of the destinations that match, such as streams that
+// are no longer written to, so they don't accumulate. Each lock is taken
+// first, so it isn't forgotten while it is in use.
+func forgetDestinations(matches func(destinationKey) bool) {
+	destinations.Lock()
+	matched := map[destinationKey]*destinationLock{}
+	for key, lock := range destinations.locks {
+		if matches(key) {
+			matched[key] = lock
+		}
+	}
+	destinations.Unlock()
+	for key, lock := range matched {
+		lock.Lock()
+		destinations.Lock()
+		if destinations.locks[key] == lock {
+			delete(destinations.locks, key)
+			lock.forgotten = true
+		}
+		destinations.Unlock()
+		lock.Unlock()
+	}
+}
+
+// records the sequence token left by an upload, for the next adapter to
+// upload to the stream - or forgets it, if the upload failed.
+func (lock *destinationLock) setToken(token *string, written bool) {
+	lock.token, lock.written = token, written
+}
+
+// forgets the sequence tokens left for every stream, by every adapter, so
+// that each is fetched again, as after a SIGHUP.
+func forgetDestinationTokens() {
+	destinations.Lock()
+	locks := []*destinationLock{}
+	for _, lock := range destinations.locks {
+		locks = append(locks, lock)
+	}
+	destinations.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+		lock.setToken(nil, false)
+		lock.Unlock()
+	}
+}
+
+// returns whether an error only says that a group or stream already exists,
+// and that is not treated as a failure.
+func (u *CloudwatchUploader) ignoreExists(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok &&
+		aerr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+		return u.existsPolicy == ALREADY_EXISTS_IGNORE
+	}
+	return false
+}
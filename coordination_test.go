@@ -0,0 +1,111 @@
+package cloudwatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// returns whether lock is locked, by trying it in another goroutine
+func locked(lock func() *destinationLock) bool {
+	acquired := make(chan *destinationLock)
+	go func() { acquired <- lock() }()
+	select {
+	case held := <-acquired:
+		held.Unlock()
+		return false
+	case <-time.After(100 * time.Millisecond):
+		go func() { (<-acquired).Unlock() }() // release it when it comes
+		return true
+	}
+}
+
+func TestGroupAndBlankStreamLocksDiffer(t *testing.T) {
+	u := &CloudwatchUploader{region: `test-group-blank`}
+	group := u.lockGroup(``, `g`)
+	defer group.Unlock()
+	if locked(func() *destinationLock { return u.lockStream(``, `g`, ``) }) {
+		t.Error("a blank stream shares its group's lock")
+	}
+}
+
+func TestStreamLocksAreShared(t *testing.T) {
+	first := &CloudwatchUploader{region: `test-shared`}
+	second := &CloudwatchUploader{region: `test-shared`}
+	lock := first.lockStream(`role`, `g`, `s`)
+	defer lock.Unlock()
+	if !locked(func() *destinationLock { return second.lockStream(`role`, `g`, `s`) }) {
+		t.Error("adapters writing to the same stream don't share its lock")
+	}
+	for name, other := range map[string]func() *destinationLock{
+		"region": func() *destinationLock {
+			u := &CloudwatchUploader{region: `test-other`}
+			return u.lockStream(`role`, `g`, `s`)
+		},
+		"role":   func() *destinationLock { return second.lockStream(`other`, `g`, `s`) },
+		"group":  func() *destinationLock { return second.lockStream(`role`, `h`, `s`) },
+		"stream": func() *destinationLock { return second.lockStream(`role`, `g`, `t`) },
+	} {
+		if locked(other) {
+			t.Errorf("a stream in another %s shares the lock", name)
+		}
+	}
+}
+
+func TestForgetDestinationTokens(t *testing.T) {
+	u := &CloudwatchUploader{region: `test-forget`}
+	lock := u.lockStream(``, `g`, `s`)
+	lock.setToken(aws.String(`token`), true)
+	lock.Unlock()
+
+	forgetDestinationTokens()
+
+	lock = u.lockStream(``, `g`, `s`)
+	defer lock.Unlock()
+	if lock.written || lock.token != nil {
+		t.Errorf("token %v is still passed on after a SIGHUP",
+			aws.StringValue(lock.token))
+	}
+}
+
+func TestAdaptersCoordinateCreation(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	adapters := []*CloudwatchAdapter{
+		f.adapter(t, map[string]string{`DELAY`: `1`}),
+		f.adapter(t, map[string]string{`DELAY`: `1`}),
+	}
+	var wait sync.WaitGroup
+	for _, a := range adapters {
+		wait.Add(1)
+		go func(u *CloudwatchUploader) {
+			defer wait.Done()
+			if err := u.ensureGroup(u.svc, ``, `shared`); err != nil {
+				t.Error(err)
+			}
+		}(a.batcher.uploader)
+	}
+	wait.Wait()
+	if count := f.count(`CreateLogGroup`); count != 1 {
+		t.Errorf("the group was created %d times, want once", count)
+	}
+
+	// both adapters upload to one stream, twice, passing the token on
+	for round := 1; round <= 2; round++ {
+		for _, a := range adapters {
+			a.batcher.Input <- CloudwatchMessage{Message: `hello`,
+				Group: `shared`, Stream: `s`, Time: time.Now()}
+		}
+		f.await(t, "the uploads", func() bool {
+			return len(f.messages(`shared`, `s`)) == 2*round
+		})
+	}
+	if count := f.count(`CreateLogStream`); count != 1 {
+		t.Errorf("the stream was created %d times, want once", count)
+	}
+	if count := f.count(`PutLogEvents`); count != 4 {
+		t.Errorf("%d uploads were made for 4 batches, so some used a stale token",
+			count)
+	}
+}
@@ -0,0 +1,55 @@
+package cloudwatch
+
+import (
+	"log"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// keeps a copy of a container's message in its rolling buffer of recent
+// lines, if crash context is enabled. Only the last few messages are kept
+// for each container, so memory stays bounded.
+func (a *CloudwatchAdapter) bufferCrashLine(msg CloudwatchMessage) {
+	if a.crashLines <= 0 {
+		return
+	}
+	lines := append(a.crashBuffers[msg.Container], msg)
+	if len(lines) > a.crashLines {
+		lines = lines[len(lines)-a.crashLines:]
+	}
+	a.crashBuffers[msg.Container] = lines
+}
+
+// writes a container's recent lines to the diagnostics group when it dies
+// with a non-zero exit code, in a stream named after the container's own
+// stream, so the context of a crash is kept even if its batches were
+// dropped. The container's buffer is then discarded.
+func (a *CloudwatchAdapter) replayCrash(event *docker.APIEvents) {
+	if a.crashLines <= 0 || event.Type != `container` || event.Action != `die` {
+		return
+	}
+	attributes := event.Actor.Attributes
+	key := a.containerKey(&docker.Container{
+		ID:     event.Actor.ID,
+		Name:   attributes[`name`],
+		Config: &docker.Config{Labels: attributes},
+	})
+	lines := a.crashBuffers[key]
+	delete(a.crashBuffers, key)
+	group := a.batcher.uploader.diagnosticsGroup
+	if attributes[`exitCode`] == `0` || len(lines) == 0 {
+		return
+	}
+	if group == "" {
+		log.Println("cloudwatch: WARNING no LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_GROUP, not keeping crash context for",
+			lines[0].source())
+		return
+	}
+	for _, msg := range lines {
+		msg.Group, msg.Role = group, ""
+		msg.Container = "" // a copy, so not fanned out or counted again
+		msg.Arrived = time.Time{}
+		a.deliver(msg)
+	}
+}
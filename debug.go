@@ -0,0 +1,342 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// the adapters created in this process, as reported by the debug endpoint
+var adapters = struct {
+	sync.Mutex
+	list []*CloudwatchAdapter
+}{}
+
+// option names whose values are replaced before being reported
+var secretOption = regexp.MustCompile(
+	`(?i)secret|password|passwd|token|credential|access_key|session`)
+
+// options whose names match secretOption, but whose values aren't secret,
+// and are reported elsewhere in the config anyway
+var publicOptions = map[string]bool{
+	`LOGSPOUT_CLOUDWATCH_TOKEN_FILE`: true,
+}
+
+const REDACTED = `REDACTED`
+
+// AdapterConfig is the effective configuration of a CloudwatchAdapter, after
+// its options have been parsed and defaults applied.
+type AdapterConfig struct {
+	Route                  string            `json:"route"`
+	Address                string            `json:"address"`
+	Region                 string            `json:"region"`
+	Endpoint               string            `json:"endpoint,omitempty"`
+	Version                string            `json:"version"`
+	UserAgent              string            `json:"user_agent,omitempty"`
+	InstanceID             string            `json:"instance_id"`
+	InstanceTags           map[string]string `json:"instance_tags,omitempty"`
+	AccountID              string            `json:"account_id,omitempty"`
+	LoggerHost             string            `json:"logger_host"`
+	Debug                  bool              `json:"debug"`
+	AWSDebug               string            `json:"aws_debug,omitempty"`
+	AWSMaxRetries          string            `json:"aws_max_retries,omitempty"`
+	RoleDuration           string            `json:"role_duration"`
+	RoleRenewal            string            `json:"role_renewal"`
+	GroupCreateWait        string            `json:"group_create_wait"`
+	CreateWait             string            `json:"create_wait"`
+	DescribeRetries        int               `json:"describe_retries"`
+	StreamHeader           string            `json:"stream_header,omitempty"`
+	TokenFile              string            `json:"token_file,omitempty"`
+	ErrorMetricsOnly       bool              `json:"error_metrics_only"`
+	OnAccessDenied         string            `json:"on_access_denied"`
+	AlreadyExists          string            `json:"already_exists"`
+	AccessDeniedInterval   string            `json:"access_denied_interval"`
+	PutLogEventsTPS        int               `json:"putlogevents_tps,omitempty"`
+	QueuedBatches          int               `json:"queued_batches"`
+	ContainerQueuedBatches int               `json:"container_queued_batches,omitempty"`
+	SplitOnConflicts       int               `json:"split_on_conflicts,omitempty"`
+	EmptyBatchWarning      int               `json:"empty_batch_warning"`
+	LogRejected            bool              `json:"log_rejected"`
+	RejectedRedact         string            `json:"rejected_redact,omitempty"`
+	CheckpointInterval     string            `json:"checkpoint_interval"`
+	DeliveryLatency        bool              `json:"delivery_latency"`
+	BatchMarkers           bool              `json:"batch_markers"`
+	OnPause                string            `json:"on_pause"`
+	DiagnosticsGroup       string            `json:"diagnostics_group,omitempty"`
+	MaxIdleConns           int               `json:"max_idle_conns"`
+	MaxIdleConnsPerHost    int               `json:"max_idle_conns_per_host"`
+	IdleConnTimeout        string            `json:"idle_conn_timeout"`
+	KeepAlive              string            `json:"keep_alive"`
+	FlushInterval          string            `json:"flush_interval"`
+	Timestamps             string            `json:"timestamps"`
+	FlushAlign             string            `json:"flush_align,omitempty"`
+	FlushOffset            string            `json:"flush_offset"`
+	AdaptiveMinEvents      int               `json:"adaptive_min_events"`
+	AdaptiveMaxAge         string            `json:"adaptive_max_age"`
+	EventsPerSecond        int               `json:"events_per_second,omitempty"`
+	PaceMaxAge             string            `json:"pace_max_age"`
+	CoalesceDelay          string            `json:"coalesce_delay"`
+	SendTimeout            string            `json:"send_timeout"`
+	ArrivalOrder           bool              `json:"arrival_order"`
+	Tee                    string            `json:"tee,omitempty"`
+	SplitStderr            bool              `json:"split_stderr"`
+	JSONFields             []string          `json:"json_fields,omitempty"`
+	JSONLabels             []string          `json:"json_labels,omitempty"`
+	JSONEnv                []string          `json:"json_env,omitempty"`
+	JSONTopLevel           bool              `json:"json_top_level"`
+	MaxMessageLength       int               `json:"max_message_length,omitempty"`
+	BodyTimestamp          string            `json:"body_timestamp,omitempty"`
+	BodyTimezone           string            `json:"body_timezone"`
+	CacheKey               string            `json:"cache_key"`
+	InspectConcurrency     int               `json:"inspect_concurrency"`
+	DockerTimeout          string            `json:"docker_timeout"`
+	DockerFailures         int               `json:"docker_failures"`
+	DockerCooldown         string            `json:"docker_cooldown"`
+	DockerMaxCooldown      string            `json:"docker_max_cooldown"`
+	RecordTerminator       string            `json:"record_terminator,omitempty"`
+	MultilineSeparator     string            `json:"multiline_separator"`
+	RecordTimeout          string            `json:"record_timeout"`
+	RecordMaxSize          int               `json:"record_max_size"`
+	MultilineMaxLines      int               `json:"multiline_max_lines"`
+	GroupChars             string            `json:"group_chars"`
+	StreamChars            string            `json:"stream_chars"`
+	GroupCase              string            `json:"group_case,omitempty"`
+	NameReplacement        string            `json:"name_replacement"`
+	SkipBacklogBefore      string            `json:"skip_backlog_before,omitempty"`
+	ErrorLabel             string            `json:"error_label,omitempty"`
+	ExcludeImages          string            `json:"exclude_images,omitempty"`
+	Transforms             string            `json:"transforms,omitempty"`
+	HealthcheckPattern     string            `json:"healthcheck_pattern,omitempty"`
+	MinLevel               string            `json:"min_level,omitempty"`
+	LevelField             string            `json:"level_field,omitempty"`
+	HostSource             string            `json:"host_source"`
+	OnBlankName            string            `json:"on_blank_name"`
+	FallbackStream         string            `json:"fallback_stream,omitempty"`
+	GroupExpr              string            `json:"group_expr,omitempty"`
+	StreamExpr             string            `json:"stream_expr,omitempty"`
+	UnnamedStream          string            `json:"unnamed_stream"`
+	StreamBucket           string            `json:"stream_bucket,omitempty"`
+	CheckTemplates         bool              `json:"check_templates"`
+	Admin                  bool              `json:"admin"`
+	LifecycleEvents        string            `json:"lifecycle_events,omitempty"`
+	CrashLines             int               `json:"crash_lines,omitempty"`
+	StartBanner            bool              `json:"start_banner"`
+	Options                map[string]string `json:"options"`     // route options
+	Environment            map[string]string `json:"environment"` // adapter options
+}
+
+// AdapterStats holds the counts of notable events in a CloudwatchAdapter.
+type AdapterStats struct {
+	Route    string           `json:"route"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+func registerAdapter(adapter *CloudwatchAdapter) {
+	adapters.Lock()
+	defer adapters.Unlock()
+	adapters.list = append(adapters.list, adapter)
+}
+
+// DebugHandler serves the effective configuration of each cloudwatch route
+// as JSON at /cloudwatch/config, and its counters at /cloudwatch/stats.
+// Routes with LOGSPOUT_CLOUDWATCH_ADMIN set can also have uploads to a log
+// group paused and resumed with a POST to /cloudwatch/pause?group=<name>
+// and /cloudwatch/resume?group=<name>, and a snapshot of their state taken
+// from /cloudwatch/snapshot.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/cloudwatch/config`, func(w http.ResponseWriter, r *http.Request) {
+		list := adminAdapters(w)
+		if list == nil {
+			return
+		}
+		configs := []AdapterConfig{}
+		for _, adapter := range list {
+			configs = append(configs, adapter.Config())
+		}
+		writeJSON(w, configs)
+	})
+	mux.HandleFunc(`/cloudwatch/pause`, pauseHandler(true))
+	mux.HandleFunc(`/cloudwatch/resume`, pauseHandler(false))
+	mux.HandleFunc(`/cloudwatch/snapshot`, snapshotHandler)
+	mux.HandleFunc(`/cloudwatch/stats`, func(w http.ResponseWriter, r *http.Request) {
+		list := adminAdapters(w)
+		if list == nil {
+			return
+		}
+		stats := []AdapterStats{}
+		for _, adapter := range list {
+			stats = append(stats, AdapterStats{
+				Route:    adapter.Route.ID,
+				Counters: adapter.stats.Snapshot(),
+			})
+		}
+		writeJSON(w, stats)
+	})
+	return mux
+}
+
+// returns the adapters with the admin endpoints enabled, as the endpoints
+// reveal the configuration, or change it. If there are none, the request
+// is refused, and nil is returned.
+func adminAdapters(w http.ResponseWriter) []*CloudwatchAdapter {
+	adapters.Lock()
+	list := []*CloudwatchAdapter{}
+	for _, adapter := range adapters.list {
+		if adapter.admin {
+			list = append(list, adapter)
+		}
+	}
+	adapters.Unlock()
+	if len(list) == 0 {
+		http.Error(w, "set LOGSPOUT_CLOUDWATCH_ADMIN to enable this endpoint",
+			http.StatusForbidden)
+		return nil
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// Config returns the adapter's effective configuration, with the values of
+// any options that look like credentials redacted.
+func (a *CloudwatchAdapter) Config() AdapterConfig {
+	uploader := a.batcher.uploader
+	transport := uploader.config.HTTPClient.Transport.(*http.Transport)
+	config := AdapterConfig{
+		Route:                  a.Route.ID,
+		Address:                a.Route.Address,
+		Region:                 uploader.region,
+		Endpoint:               uploader.endpoint,
+		Version:                Version,
+		UserAgent:              routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_USER_AGENT`, ""),
+		InstanceID:             a.Ec2Instance,
+		InstanceTags:           a.InstanceTags,
+		AccountID:              a.AccountID(),
+		LoggerHost:             a.OsHost,
+		Debug:                  uploader.debugSet,
+		AWSDebug:               routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_AWS_DEBUG`, ""),
+		AWSMaxRetries:          routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_AWS_MAX_RETRIES`, ""),
+		RoleDuration:           uploader.roleDuration.String(),
+		RoleRenewal:            uploader.roleRenewal.String(),
+		GroupCreateWait:        uploader.groupCreateWait.String(),
+		CreateWait:             uploader.createWait.String(),
+		DescribeRetries:        uploader.describeRetries,
+		StreamHeader:           routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_STREAM_HEADER`, ""),
+		TokenFile:              uploader.tokenFile,
+		ErrorMetricsOnly:       uploader.metricsOnly,
+		OnAccessDenied:         uploader.deniedPolicy,
+		AlreadyExists:          uploader.existsPolicy,
+		AccessDeniedInterval:   uploader.deniedInterval.String(),
+		PutLogEventsTPS:        routeIntOption(a.Route, `LOGSPOUT_CLOUDWATCH_PUTLOGEVENTS_TPS`, 0),
+		QueuedBatches:          uploader.queueLimit,
+		ContainerQueuedBatches: uploader.containerLimit,
+		SplitOnConflicts:       uploader.splitAfter,
+		EmptyBatchWarning:      uploader.emptyWarning,
+		LogRejected:            uploader.samples,
+		RejectedRedact:         patternString(uploader.sampleRedact),
+		CheckpointInterval:     uploader.checkpointInterval.String(),
+		DeliveryLatency:        uploader.latency,
+		BatchMarkers:           uploader.markers,
+		OnPause:                uploader.pausePolicy,
+		DiagnosticsGroup:       uploader.diagnosticsGroup,
+		MaxIdleConns:           transport.MaxIdleConns,
+		MaxIdleConnsPerHost:    transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:        transport.IdleConnTimeout.String(),
+		KeepAlive:              routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_KEEP_ALIVE`, DEFAULT_KEEP_ALIVE.String()),
+		FlushInterval:          a.batcher.delay.String(),
+		Timestamps:             a.batcher.timestamps,
+		FlushAlign:             a.batcher.align,
+		FlushOffset:            a.batcher.offset.String(),
+		AdaptiveMinEvents:      a.batcher.adaptiveMinEvents,
+		AdaptiveMaxAge:         a.batcher.adaptiveMaxAge.String(),
+		EventsPerSecond:        a.batcher.pace,
+		PaceMaxAge:             a.batcher.paceMaxAge.String(),
+		CoalesceDelay:          a.batcher.coalesceDelay.String(),
+		SendTimeout:            a.batcher.sendTimeout.String(),
+		ArrivalOrder:           a.arrivalOrder,
+		Tee:                    routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_TEE`, ""),
+		SplitStderr:            a.splitStderr,
+		JSONFields:             a.jsonFields,
+		JSONLabels:             a.jsonLabels,
+		JSONEnv:                a.jsonEnv,
+		JSONTopLevel:           a.jsonTopLevel,
+		MaxMessageLength:       a.maxLength,
+		BodyTimestamp:          a.bodyTimestamp,
+		BodyTimezone:           a.bodyLocation.String(),
+		CacheKey:               a.cacheKey,
+		InspectConcurrency:     cap(a.inspectSlots),
+		DockerTimeout:          a.inspectTimeout.String(),
+		DockerFailures:         a.dockerBreaker.Threshold,
+		DockerCooldown:         a.dockerBreaker.Cooldown.String(),
+		DockerMaxCooldown:      a.dockerBreaker.MaxCooldown.String(),
+		RecordTerminator:       a.recordTerminator,
+		MultilineSeparator:     a.recordSeparator,
+		RecordTimeout:          a.recordTimeout.String(),
+		RecordMaxSize:          a.recordMaxSize,
+		MultilineMaxLines:      a.recordMaxLines,
+		GroupChars:             routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_GROUP_CHARS`, DEFAULT_GROUP_CHARS),
+		StreamChars:            routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_STREAM_CHARS`, DEFAULT_STREAM_CHARS),
+		GroupCase:              a.groupSanitizer.Case,
+		NameReplacement:        a.groupSanitizer.Replacement,
+		SkipBacklogBefore:      timeString(a.skipBefore),
+		ErrorLabel:             a.errorLabelName,
+		ExcludeImages:          patternString(a.excludeImages),
+		Transforms:             routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_TRANSFORMS`, ""),
+		HealthcheckPattern:     patternString(a.healthchecks),
+		MinLevel:               routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_MIN_LEVEL`, ""),
+		LevelField:             routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_LEVEL_FIELD`, ""),
+		HostSource:             a.hostSource,
+		OnBlankName:            a.blankPolicy,
+		FallbackStream:         a.fallbackStream,
+		GroupExpr:              routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_GROUP_EXPR`, ""),
+		StreamExpr:             routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_STREAM_EXPR`, ""),
+		UnnamedStream:          a.unnamedStreams,
+		StreamBucket:           routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_STREAM_BUCKET`, ""),
+		CheckTemplates:         routeFlag(a.Route, `LOGSPOUT_CLOUDWATCH_CHECK_TEMPLATES`),
+		Admin:                  a.admin,
+		LifecycleEvents:        routeOption(a.Route, `LOGSPOUT_CLOUDWATCH_LIFECYCLE_EVENTS`, ""),
+		CrashLines:             a.crashLines,
+		StartBanner:            a.startBanners,
+		Options:                map[string]string{},
+		Environment:            map[string]string{},
+	}
+	for key, value := range a.Route.Options {
+		config.Options[key] = redact(key, value)
+	}
+	for key := range optionValidators {
+		if value := os.Getenv(key); value != "" {
+			config.Environment[key] = redact(key, value)
+		}
+	}
+	return config
+}
+
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func patternString(pattern *regexp.Regexp) string {
+	if pattern == nil {
+		return ""
+	}
+	return pattern.String()
+}
+
+func redact(key, value string) string {
+	if secretOption.MatchString(key) && !publicOptions[key] {
+		return REDACTED
+	}
+	return value
+}
@@ -0,0 +1,25 @@
+package cloudwatch
+
+import "testing"
+
+func TestConfigListsEveryOptionSet(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	t.Setenv(`LOGSPOUT_CLOUDWATCH_USER_AGENT`, `my-app`)
+	t.Setenv(`LOGSPOUT_CLOUDWATCH_TOKEN_FILE`, `/var/lib/logspout/tokens.json`)
+	config := f.adapter(t, map[string]string{`API_SECRET`: `hunter2`}).Config()
+	for key, want := range map[string]string{
+		`LOGSPOUT_CLOUDWATCH_USER_AGENT`: `my-app`,
+		`LOGSPOUT_CLOUDWATCH_TOKEN_FILE`: `/var/lib/logspout/tokens.json`,
+	} {
+		if value := config.Environment[key]; value != want {
+			t.Errorf("environment %s is %q, want %q", key, value, want)
+		}
+	}
+	if config.Options[`LOGSPOUT_CLOUDWATCH_REGION`] != `us-east-1` ||
+		config.Options[`API_SECRET`] != REDACTED {
+		t.Errorf("got options %v", config.Options)
+	}
+	if config.TokenFile != `/var/lib/logspout/tokens.json` {
+		t.Errorf("got token file %q", config.TokenFile)
+	}
+}
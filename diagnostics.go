@@ -0,0 +1,55 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// a diagnostic event, written to LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_GROUP when
+// a batch is dropped, so alerts can be raised from Cloudwatch itself
+type dropEvent struct {
+	Event  string `json:"event"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+	Group  string `json:"group"`
+	Stream string `json:"stream"`
+}
+
+// records a diagnostic event for a dropped batch, if a diagnostics group is
+// configured. Drops from the diagnostics group itself are not recorded, so
+// a failing diagnostics group can't feed itself.
+func (u *CloudwatchUploader) reportDrop(batch CloudwatchBatch, reason string) {
+	msg := batch.Msgs[0]
+	if u.diagnosticsGroup == "" || msg.Group == u.diagnosticsGroup {
+		return
+	}
+	encoded, err := json.Marshal(dropEvent{
+		Event:  `batch_dropped`,
+		Reason: reason,
+		Count:  len(batch.Msgs),
+		Group:  msg.Group,
+		Stream: msg.Stream,
+	})
+	if err != nil {
+		return
+	}
+	if u.diagnostics == nil {
+		u.diagnostics = NewCloudwatchBatch()
+	}
+	u.diagnostics.Append(CloudwatchMessage{
+		Message: string(encoded),
+		Group:   u.diagnosticsGroup,
+		Stream:  u.diagnosticsStream,
+		Time:    time.Now(),
+	})
+}
+
+// uploads the diagnostic events recorded since the last call, if any
+func (u *CloudwatchUploader) flushDiagnostics() {
+	if u.diagnostics == nil {
+		return
+	}
+	batch := *u.diagnostics
+	u.diagnostics = nil
+	u.submit(batch)
+}
@@ -0,0 +1,36 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestDroppedBatchIsReported(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	f.failures[`PutLogEvents`] = []string{cloudwatchlogs.ErrCodeInvalidParameterException}
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_GROUP`:  `diagnostics`,
+		`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_STREAM`: `drops`})
+	for _, text := range []string{`one`, `two`} {
+		a.batcher.Input <- CloudwatchMessage{Message: text, Group: `g`, Stream: `s`,
+			Time: time.Now()}
+	}
+	f.await(t, "the drop to be reported", func() bool {
+		return len(f.messages(`diagnostics`, `drops`)) == 1
+	})
+	event := dropEvent{}
+	if err := json.Unmarshal([]byte(f.messages(`diagnostics`, `drops`)[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	want := dropEvent{Event: `batch_dropped`, Count: 2, Group: `g`, Stream: `s`,
+		Reason: cloudwatchlogs.ErrCodeInvalidParameterException}
+	if event != want {
+		t.Errorf("reported %+v, want %+v", event, want)
+	}
+	if len(f.messages(`g`, `s`)) != 0 {
+		t.Error("uploaded the failed batch")
+	}
+}
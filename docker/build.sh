@@ -1,14 +1,19 @@
-#!/bin/sh
-set -e
-apk add --update go build-base git mercurial ca-certificates
-mkdir -p /go/src/github.com/gliderlabs
-cp -r /src /go/src/github.com/gliderlabs/logspout
-cd /go/src/github.com/gliderlabs/logspout
-export GOPATH=/go
-go get
-go build -ldflags "-X main.Version=$1" -o /bin/logspout
-apk del go git mercurial build-base
-rm -rf /go /var/cache/apk/* /root/.glide
-
-# backwards compatibility
-ln -fs /tmp/docker.sock /var/run/docker.sock
+#!/bin/sh
+set -e
+apk add --update go build-base git mercurial ca-certificates
+mkdir -p /go/src/github.com/gliderlabs
+cp -r /src /go/src/github.com/gliderlabs/logspout
+cd /go/src/github.com/gliderlabs/logspout
+export GOPATH=/go
+# go get fetches the latest version of anything missing, so dependencies
+# that must stay at a known version are checked out first
+EXPR_VERSION=v1.16.9
+git clone --quiet --depth 1 --branch $EXPR_VERSION \
+  https://github.com/expr-lang/expr /go/src/github.com/expr-lang/expr
+go get
+go build -ldflags "-X main.Version=$1" -o /bin/logspout
+apk del go git mercurial build-base
+rm -rf /go /var/cache/apk/* /root/.glide
+
+# backwards compatibility
+ln -fs /tmp/docker.sock /var/run/docker.sock
@@ -1,15 +1,22 @@
 package cloudwatch
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/gliderlabs/logspout/router"
 )
 
+// LOGSPOUT_CLOUDWATCH_INSTANCE_TAGS value that fetches every tag
+const ALL_INSTANCE_TAGS = "*"
+
 type EC2Info struct {
 	InstanceID string
 	Region     string
@@ -17,7 +24,9 @@ type EC2Info struct {
 
 func NewEC2Info(route *router.Route) (EC2Info, error) {
 	_, skip_ec2 := route.Options[`NOEC2`]
-	if skip_ec2 || (os.Getenv(`NOEC2`) != "") {
+	_, skip_metadata := route.Options[`LOGSPOUT_CLOUDWATCH_SKIP_EC2_METADATA`]
+	if skip_ec2 || skip_metadata || (os.Getenv(`NOEC2`) != "") ||
+		(os.Getenv(`LOGSPOUT_CLOUDWATCH_SKIP_EC2_METADATA`) != "") {
 		return EC2Info{}, nil
 	}
 	// get my instance ID
@@ -40,3 +49,50 @@ func NewEC2Info(route *router.Route) (EC2Info, error) {
 		Region:     region,
 	}, nil
 }
+
+// returns the tags of this EC2 instance named in a comma-separated list, or
+// all of them for ALL_INSTANCE_TAGS, from the EC2 API. Tags can't be read
+// without the ec2:DescribeTags permission, or off EC2, in which case a
+// warning is logged and no tags are returned.
+func (u *CloudwatchUploader) instanceTags(names string) map[string]string {
+	tags := map[string]string{}
+	if u.adapter.Ec2Instance == "" {
+		log.Println("cloudwatch: WARNING not on EC2, so no instance tags")
+		return tags
+	}
+	filters := []*ec2.Filter{{
+		Name:   aws.String(`resource-id`),
+		Values: aws.StringSlice([]string{u.adapter.Ec2Instance}),
+	}}
+	if names != ALL_INSTANCE_TAGS {
+		keys := []string{}
+		for _, name := range strings.Split(names, `,`) {
+			if name = strings.TrimSpace(name); name != "" {
+				keys = append(keys, name)
+			}
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(`key`),
+			Values: aws.StringSlice(keys),
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), INSTANCE_TAGS_TIMEOUT)
+	defer cancel()
+	// the instance's own region, which Cloudwatch Logs may not be in
+	svc := ec2.New(u.session, u.config.Copy(&aws.Config{
+		Region: aws.String(u.adapter.Ec2Region),
+	}))
+	err := svc.DescribeTagsPagesWithContext(ctx,
+		&ec2.DescribeTagsInput{Filters: filters},
+		func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+			for _, tag := range page.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			return true
+		})
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not get EC2 instance tags:", err)
+		return map[string]string{}
+	}
+	return tags
+}
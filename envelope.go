@@ -0,0 +1,192 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// the format of @timestamp in JSON events - ISO 8601, in UTC, to the
+// millisecond, as Cloudwatch timestamps are
+const JSON_TIMESTAMP_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+const DEFAULT_JSON_FIELDS = "container_name,container_id"
+
+// with LOGSPOUT_CLOUDWATCH_JSON_TOP_LEVEL, prefixes the attributes whose
+// names are taken by the event's own fields
+const ATTRIBUTE_PREFIX = "attr_"
+
+// ends messages cut short by LOGSPOUT_CLOUDWATCH_MAX_MESSAGE_LENGTH
+const TRUNCATION_MARKER = "...[truncated]"
+
+// the metadata fields that can be added to JSON events, by name
+var jsonFields = map[string]func(*CloudwatchAdapter, CloudwatchMessage) string{
+	`container_name`: func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return msg.ContainerName },
+	`container_id`:   func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return msg.ContainerID },
+	`label`:          func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return msg.Label },
+	`group`:          func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return msg.Group },
+	`stream`:         func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return msg.Stream },
+	`logger_host`:    func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return a.OsHost },
+	`instance_id`:    func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return a.Ec2Instance },
+	`region`:         func(a *CloudwatchAdapter, msg CloudwatchMessage) string { return a.Ec2Region },
+}
+
+// the values of a container's labels, by name
+type labelSet map[string]string
+
+// returns the label names in a comma-separated list
+func parseLabelNames(text string) []string {
+	names := []string{}
+	for _, name := range strings.Split(text, `,`) {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// returns the container's values of the environment variables named in
+// LOGSPOUT_CLOUDWATCH_JSON_ENV and the labels named in
+// LOGSPOUT_CLOUDWATCH_JSON_LABELS, for the attributes of its JSON events, or
+// nil if it has none of them. Missing ones are left out, and a label wins
+// over a variable of the same name.
+func (a *CloudwatchAdapter) labelAttributes(containerData *docker.Container) labelSet {
+	if a.jsonFields == nil || containerData.Config == nil {
+		return nil
+	}
+	var attributes labelSet
+	add := func(values map[string]string, names []string) {
+		for _, name := range names {
+			if value, exists := values[name]; exists {
+				if attributes == nil {
+					attributes = labelSet{}
+				}
+				attributes[name] = value
+			}
+		}
+	}
+	add(parseEnv(containerData.Config.Env), a.jsonEnv)
+	add(containerData.Config.Labels, a.jsonLabels)
+	return attributes
+}
+
+// returns the name of an attribute as a top-level field of a JSON event,
+// prefixed if it is a field of the event's own, even one not enabled, so
+// each attribute's field name is the same in every event.
+func attributeField(name string) string {
+	if _, reserved := jsonFields[name]; reserved || strings.HasPrefix(name, `@`) ||
+		name == `attributes` || strings.HasPrefix(name, ATTRIBUTE_PREFIX) {
+		return ATTRIBUTE_PREFIX + name
+	}
+	return name
+}
+
+// returns the JSON metadata fields named in a comma-separated list
+func parseJSONFields(text string) ([]string, error) {
+	fields := []string{}
+	for _, field := range strings.Split(text, `,`) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, exists := jsonFields[field]; !exists {
+			return nil, fmt.Errorf("unknown JSON field %s", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// returns the message with its time prepended to its text, in the layout
+// and time zone set for the body, if a layout is set. The event's own
+// Cloudwatch timestamp is unchanged.
+func (a *CloudwatchAdapter) stampBody(msg CloudwatchMessage) CloudwatchMessage {
+	if a.bodyTimestamp != "" {
+		msg.Message = msg.Time.In(a.bodyLocation).Format(a.bodyTimestamp) +
+			" " + msg.Message
+	}
+	return msg
+}
+
+// returns text cut to a length, in bytes, if it is longer, ending in
+// TRUNCATION_MARKER - unless the length is too short to hold it. The text is
+// cut between characters, so it stays valid UTF-8.
+func truncateText(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	marker := TRUNCATION_MARKER
+	if len(marker) >= length {
+		marker = ""
+	}
+	keep := length - len(marker)
+	for keep > 0 && !utf8.RuneStart(text[keep]) {
+		keep--
+	}
+	return text[:keep] + marker
+}
+
+// returns the message with its text wrapped in a JSON object, holding the
+// text as @message, its time as @timestamp, and the configured metadata
+// fields - or the message unchanged, if JSON events are not enabled. Any
+// body timestamp is added to the text first. If a maximum message length is
+// set, it applies to the event as uploaded: with JSON events, the text is
+// cut until the encoded event fits, escaping included, so it stays valid.
+func (a *CloudwatchAdapter) format(msg CloudwatchMessage) CloudwatchMessage {
+	msg = a.stampBody(msg)
+	if a.jsonFields == nil {
+		if a.maxLength > 0 && len(msg.Message) > a.maxLength {
+			msg.Message = truncateText(msg.Message, a.maxLength)
+			a.stats.Add(`length_truncated`, 1)
+		}
+		return msg
+	}
+	encoded, err := a.encode(msg, msg.Message)
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not encode JSON event:", err)
+		return msg
+	}
+	if a.maxLength > 0 && len(encoded) > a.maxLength {
+		// escaping makes some characters longer, so search for the longest
+		// cut of the text whose event fits
+		encoded, _ = a.encode(msg, "")
+		for shortest, longest := 0, len(msg.Message)-1; shortest <= longest; {
+			length := (shortest + longest) / 2
+			if cut, _ := a.encode(msg, truncateText(msg.Message, length)); len(cut) <= a.maxLength {
+				encoded, shortest = cut, length+1
+			} else {
+				longest = length - 1
+			}
+		}
+		a.stats.Add(`length_truncated`, 1)
+	}
+	msg.Message = encoded
+	return msg
+}
+
+// returns a message encoded as a JSON event, with the given text, and its
+// container's attributes - in an attributes object, or as top-level fields
+func (a *CloudwatchAdapter) encode(msg CloudwatchMessage, text string) (string, error) {
+	event := map[string]interface{}{
+		`@timestamp`: msg.Time.UTC().Format(JSON_TIMESTAMP_FORMAT),
+		`@message`:   text,
+	}
+	for _, field := range a.jsonFields {
+		if value := jsonFields[field](a, msg); value != "" {
+			event[field] = value
+		}
+	}
+	if len(msg.Attributes) > 0 && a.jsonTopLevel {
+		for name, value := range msg.Attributes {
+			event[attributeField(name)] = value
+		}
+	} else if len(msg.Attributes) > 0 {
+		event[`attributes`] = msg.Attributes
+	}
+	encoded, err := json.Marshal(event)
+	return string(encoded), err
+}
@@ -0,0 +1,112 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// returns an adapter that formats messages, with the given maximum length,
+// as JSON events if fields are given
+func formatAdapter(maxLength int, fields []string) *CloudwatchAdapter {
+	return &CloudwatchAdapter{maxLength: maxLength, jsonFields: fields,
+		stats: NewCounters()}
+}
+
+func TestFormatTruncatesToMaxLength(t *testing.T) {
+	a := formatAdapter(20, nil)
+	for _, text := range []string{strings.Repeat(`a`, 100), strings.Repeat(`é`, 100)} {
+		message := a.format(CloudwatchMessage{Message: text}).Message
+		if len(message) > 20 || !strings.HasSuffix(message, TRUNCATION_MARKER) {
+			t.Errorf("got %q, want at most 20 bytes ending in the marker", message)
+		}
+		if !utf8.ValidString(message) {
+			t.Errorf("%q is not valid UTF-8", message)
+		}
+	}
+	if message := a.format(CloudwatchMessage{Message: `short`}).Message; message != `short` {
+		t.Errorf("got %q, want a short message unchanged", message)
+	}
+	if count := a.stats.Snapshot()[`length_truncated`]; count != 2 {
+		t.Errorf("counted %d truncated messages, want 2", count)
+	}
+}
+
+func TestFormatTruncatesEncodedJSONEvents(t *testing.T) {
+	a := formatAdapter(150, []string{`container_name`})
+	for _, text := range []string{
+		strings.Repeat(`"<tab>"`+"\t", 30), // grows when escaped
+		strings.Repeat(`日本語`, 30),
+	} {
+		msg := CloudwatchMessage{Message: text, ContainerName: `web`, Time: time.Now()}
+		message := a.format(msg).Message
+		if len(message) > 150 {
+			t.Errorf("event of %d bytes is over the limit: %s", len(message), message)
+		}
+		event := map[string]string{}
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			t.Fatalf("%s is not valid JSON: %s", message, err)
+		}
+		if !strings.HasSuffix(event[`@message`], TRUNCATION_MARKER) ||
+			!strings.HasPrefix(text, strings.TrimSuffix(event[`@message`], TRUNCATION_MARKER)) {
+			t.Errorf("@message %q is not the start of the text", event[`@message`])
+		}
+		if event[`container_name`] != `web` {
+			t.Errorf("lost the metadata of %s", message)
+		}
+	}
+}
+
+func TestLabelsAreAddedAsAttributes(t *testing.T) {
+	a := formatAdapter(0, []string{})
+	a.jsonLabels = parseLabelNames(`app.version, app.commit,app.region`)
+	container := &docker.Container{Config: &docker.Config{Labels: map[string]string{
+		`app.version`: `1.4.2`, `app.commit`: `4f3c2a1`, `other`: `ignored`}}}
+	msg := CloudwatchMessage{Message: `hello`, Time: time.Now(),
+		Attributes: a.labelAttributes(container)}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(a.format(msg).Message), &event); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{`app.version`: `1.4.2`, `app.commit`: `4f3c2a1`}
+	if !reflect.DeepEqual(event[`attributes`], want) {
+		t.Errorf("got attributes %v, want %v", event[`attributes`], want)
+	}
+
+	unlabelled := &docker.Container{Config: &docker.Config{}}
+	msg.Attributes = a.labelAttributes(unlabelled)
+	if message := a.format(msg).Message; strings.Contains(message, `attributes`) {
+		t.Errorf("%s has attributes, but the container has none of the labels", message)
+	}
+}
+
+func TestAttributesAsTopLevelFields(t *testing.T) {
+	a := formatAdapter(0, []string{`container_name`})
+	a.jsonLabels, a.jsonEnv = []string{`service`, `stream`}, []string{`level`, `@message`}
+	a.jsonTopLevel = true
+	container := &docker.Container{Config: &docker.Config{
+		Labels: map[string]string{`service`: `api`, `stream`: `blue`},
+		Env:    []string{`level=debug`, `@message=spoofed`, `PATH=/bin`},
+	}}
+	msg := CloudwatchMessage{Message: `hello`, ContainerName: `web`, Time: time.Now(),
+		Attributes: a.labelAttributes(container)}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(a.format(msg).Message), &event); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{`service`: `api`, `level`: `debug`,
+		`attr_stream`: `blue`, `attr_@message`: `spoofed`, `@message`: `hello`,
+		`container_name`: `web`} {
+		if event[field] != want {
+			t.Errorf("field %s is %v, want %s", field, event[field], want)
+		}
+	}
+	if _, nested := event[`attributes`]; nested {
+		t.Error("attributes are nested as well")
+	}
+}
@@ -0,0 +1,210 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// a fake Cloudwatch Logs API for testing the adapter end to end. It keeps
+// the groups and streams created, and the events put to them, and checks
+// sequence tokens as Cloudwatch used to. Any action can be made to fail.
+type fakeCloudwatch struct {
+	sync.Mutex
+	server   *httptest.Server
+	groups   map[string]bool
+	streams  map[string]*fakeStream // by group and stream, as "group/stream"
+	calls    map[string]int         // requests, by action
+	puts     []cloudwatchlogs.PutLogEventsInput
+	failures map[string][]string // error codes that each action fails with next
+	// the Retry-After header sent with those failures, if set
+	retryAfter string
+}
+
+// a log stream in the fake Cloudwatch Logs
+type fakeStream struct {
+	token  int // the number of uploads, which is its sequence token
+	events []*cloudwatchlogs.InputLogEvent
+}
+
+// starts a fake Cloudwatch Logs API, which is stopped when the test ends
+func newFakeCloudwatch(t *testing.T) *fakeCloudwatch {
+	f := &fakeCloudwatch{
+		groups:   map[string]bool{},
+		streams:  map[string]*fakeStream{},
+		calls:    map[string]int{},
+		failures: map[string][]string{},
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	t.Setenv(`AWS_ACCESS_KEY_ID`, `test`)
+	t.Setenv(`AWS_SECRET_ACCESS_KEY`, `test`)
+	return f
+}
+
+// returns an adapter that uploads to the fake, with the given route options
+// set besides those that point it there
+func (f *fakeCloudwatch) adapter(t *testing.T, options map[string]string) *CloudwatchAdapter {
+	route := &router.Route{Address: `auto`, Options: map[string]string{
+		`NOEC2`:                               ``,
+		`LOGSPOUT_CLOUDWATCH_REGION`:          `us-east-1`,
+		`LOGSPOUT_CLOUDWATCH_ENDPOINT`:        f.server.URL,
+		`LOGSPOUT_CLOUDWATCH_AWS_MAX_RETRIES`: `0`,
+	}}
+	for key, value := range options {
+		route.Options[key] = value
+	}
+	adapter, err := NewCloudwatchAdapter(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adapter.(*CloudwatchAdapter)
+}
+
+// returns the sequence token of a stream after the given number of uploads
+func fakeToken(uploads int) *string {
+	if uploads == 0 {
+		return nil
+	}
+	return aws.String(fmt.Sprintf("token-%d", uploads))
+}
+
+// returns how many requests were made for an action
+func (f *fakeCloudwatch) count(action string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[action]
+}
+
+// returns the messages put to a stream, in order
+func (f *fakeCloudwatch) messages(group, stream string) []string {
+	f.Lock()
+	defer f.Unlock()
+	messages := []string{}
+	if s, exists := f.streams[group+`/`+stream]; exists {
+		for _, event := range s.events {
+			messages = append(messages, aws.StringValue(event.Message))
+		}
+	}
+	return messages
+}
+
+// waits up to a few seconds for a condition on the fake to hold
+func (f *fakeCloudwatch) await(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func (f *fakeCloudwatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get(`X-Amz-Target`), `Logs_20140328.`)
+	f.Lock()
+	defer f.Unlock()
+	f.calls[action]++
+	if codes := f.failures[action]; len(codes) > 0 {
+		f.failures[action] = codes[1:]
+		f.fail(w, codes[0], nil)
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	switch action {
+	case `DescribeLogGroups`:
+		params := cloudwatchlogs.DescribeLogGroupsInput{}
+		decoder.Decode(&params)
+		groups := []map[string]string{}
+		for group := range f.groups {
+			if strings.HasPrefix(group, aws.StringValue(params.LogGroupNamePrefix)) {
+				groups = append(groups, map[string]string{`logGroupName`: group})
+			}
+		}
+		f.reply(w, map[string]interface{}{`logGroups`: groups})
+	case `CreateLogGroup`:
+		params := cloudwatchlogs.CreateLogGroupInput{}
+		decoder.Decode(&params)
+		if f.groups[aws.StringValue(params.LogGroupName)] {
+			f.fail(w, cloudwatchlogs.ErrCodeResourceAlreadyExistsException, nil)
+			return
+		}
+		f.groups[aws.StringValue(params.LogGroupName)] = true
+		f.reply(w, map[string]interface{}{})
+	case `DescribeLogStreams`:
+		params := cloudwatchlogs.DescribeLogStreamsInput{}
+		decoder.Decode(&params)
+		group := aws.StringValue(params.LogGroupName)
+		if !f.groups[group] {
+			f.fail(w, cloudwatchlogs.ErrCodeResourceNotFoundException, nil)
+			return
+		}
+		streams := []map[string]interface{}{}
+		for name, stream := range f.streams {
+			name = strings.TrimPrefix(name, group+`/`)
+			if strings.HasPrefix(name, aws.StringValue(params.LogStreamNamePrefix)) {
+				streams = append(streams, map[string]interface{}{
+					`logStreamName`: name, `uploadSequenceToken`: fakeToken(stream.token)})
+			}
+		}
+		f.reply(w, map[string]interface{}{`logStreams`: streams})
+	case `CreateLogStream`:
+		params := cloudwatchlogs.CreateLogStreamInput{}
+		decoder.Decode(&params)
+		name := aws.StringValue(params.LogGroupName) + `/` + aws.StringValue(params.LogStreamName)
+		if _, exists := f.streams[name]; exists {
+			f.fail(w, cloudwatchlogs.ErrCodeResourceAlreadyExistsException, nil)
+			return
+		}
+		f.streams[name] = &fakeStream{}
+		f.reply(w, map[string]interface{}{})
+	case `PutLogEvents`:
+		params := cloudwatchlogs.PutLogEventsInput{}
+		decoder.Decode(&params)
+		stream, exists := f.streams[aws.StringValue(params.LogGroupName)+`/`+
+			aws.StringValue(params.LogStreamName)]
+		if !exists {
+			f.fail(w, cloudwatchlogs.ErrCodeResourceNotFoundException, nil)
+			return
+		}
+		if aws.StringValue(params.SequenceToken) != aws.StringValue(fakeToken(stream.token)) {
+			f.fail(w, cloudwatchlogs.ErrCodeInvalidSequenceTokenException,
+				fakeToken(stream.token))
+			return
+		}
+		f.puts = append(f.puts, params)
+		stream.events = append(stream.events, params.LogEvents...)
+		stream.token++
+		f.reply(w, map[string]interface{}{`nextSequenceToken`: fakeToken(stream.token)})
+	default:
+		f.reply(w, map[string]interface{}{})
+	}
+}
+
+// answers a request with the given value, in JSON
+func (f *fakeCloudwatch) reply(w http.ResponseWriter, value interface{}) {
+	w.Header().Set(`Content-Type`, `application/x-amz-json-1.1`)
+	json.NewEncoder(w).Encode(value)
+}
+
+// answers a request with an AWS error, and the token the stream expects, if
+// the error is about the token
+func (f *fakeCloudwatch) fail(w http.ResponseWriter, code string, expected *string) {
+	w.Header().Set(`Content-Type`, `application/x-amz-json-1.1`)
+	if f.retryAfter != "" {
+		w.Header().Set(`Retry-After`, f.retryAfter)
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{`__type`: code,
+		`message`: `fake ` + code, `expectedSequenceToken`: expected})
+}
@@ -0,0 +1,67 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// the fields available to the LOGSPOUT_CLOUDWATCH_STREAM_HEADER template
+type headerContext struct {
+	Group      string // the new stream's log group
+	Stream     string // the new stream's name
+	LoggerHost string // hostname of logging container (os.Hostname)
+	InstanceID string // EC2 Instance ID
+	Region     string // EC2 region
+	AccountID  string // AWS account ID of the credentials
+	Version    string // the adapter's version
+}
+
+// writes the header event, if one is configured, to a log stream that was
+// just created, timestamped with the first event to follow it, so it is the
+// stream's first event. Returns the stream's next sequence token.
+func (u *CloudwatchUploader) sendHeader(svc *cloudwatchlogs.CloudWatchLogs,
+	msg CloudwatchMessage) (*string, error) {
+	if u.header == nil {
+		return nil, nil
+	}
+	var header bytes.Buffer
+	err := u.header.Execute(&header, headerContext{
+		Group:      msg.Group,
+		Stream:     msg.Stream,
+		LoggerHost: u.adapter.OsHost,
+		InstanceID: u.adapter.Ec2Instance,
+		Region:     u.adapter.Ec2Region,
+		AccountID:  u.adapter.contextAccountID(nil),
+		Version:    Version,
+	})
+	if err != nil || header.Len() == 0 {
+		u.log("Not writing header to %s-%s: %v", msg.Group, msg.Stream, err)
+		return nil, nil
+	}
+	u.log("Writing header to %s-%s", msg.Group, msg.Stream)
+	u.waitForQuota()
+	resp, err := svc.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogEvents: []*cloudwatchlogs.InputLogEvent{{
+			Message:   aws.String(header.String()),
+			Timestamp: aws.Int64(msg.Time.UnixNano() / 1000000),
+		}},
+		LogGroupName:  aws.String(msg.Group),
+		LogStreamName: aws.String(msg.Stream),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.NextSequenceToken, nil
+}
+
+// parses the LOGSPOUT_CLOUDWATCH_STREAM_HEADER template, or returns nil if
+// no header is configured
+func parseHeader(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("header").Parse(text)
+}
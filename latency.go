@@ -0,0 +1,47 @@
+package cloudwatch
+
+import "time"
+
+// the upper bounds of the delivery latency histogram's buckets, and the
+// counter each is reported as. Slower deliveries are counted as
+// delivery_latency_over_5m.
+var latencyBuckets = []struct {
+	Limit   time.Duration
+	Counter string
+}{
+	{time.Second, `delivery_latency_under_1s`},
+	{5 * time.Second, `delivery_latency_under_5s`},
+	{10 * time.Second, `delivery_latency_under_10s`},
+	{30 * time.Second, `delivery_latency_under_30s`},
+	{time.Minute, `delivery_latency_under_1m`},
+	{5 * time.Minute, `delivery_latency_under_5m`},
+}
+
+// counts how long each event of an uploaded batch took from arriving at
+// logspout to being accepted by Cloudwatch, if delivery latency is measured.
+// Only the arrival time is used, so events' own timestamps are unaffected.
+func (u *CloudwatchUploader) recordLatency(batch CloudwatchBatch) {
+	if !u.latency {
+		return
+	}
+	now := time.Now()
+	for _, msg := range batch.Msgs {
+		if msg.Arrived.IsZero() { // not from a container
+			continue
+		}
+		latency := now.Sub(msg.Arrived)
+		u.adapter.stats.Add(`delivery_latency_events`, 1)
+		u.adapter.stats.Add(`delivery_latency_ms_total`, latency.Milliseconds())
+		u.adapter.stats.Add(latencyCounter(latency), 1)
+	}
+}
+
+// returns the counter of the histogram bucket for the given latency
+func latencyCounter(latency time.Duration) string {
+	for _, bucket := range latencyBuckets {
+		if latency < bucket.Limit {
+			return bucket.Counter
+		}
+	}
+	return `delivery_latency_over_5m`
+}
@@ -0,0 +1,107 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// matches the first severity word in a line, such as INFO or warning, when
+// LOGSPOUT_CLOUDWATCH_MIN_LEVEL is set
+const DEFAULT_LEVEL_PATTERN = `(?i)\b(trace|debug|info|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|panic)\b`
+
+// LOGSPOUT_CLOUDWATCH_UNKNOWN_LEVEL policies, for lines with no level
+const UNKNOWN_LEVEL_KEEP = "keep"
+const UNKNOWN_LEVEL_DROP = "drop"
+
+// the severity of each level name, in lower case
+var levels = map[string]int{
+	`trace`:    0,
+	`debug`:    1,
+	`info`:     2,
+	`warn`:     3,
+	`warning`:  3,
+	`err`:      4,
+	`error`:    4,
+	`crit`:     5,
+	`critical`: 5,
+	`fatal`:    5,
+	`panic`:    5,
+}
+
+// levelFilter drops lines whose severity is below a minimum level. The level
+// is read from a JSON field, if one is named and the line is a JSON object,
+// or otherwise from the first match of a pattern.
+type levelFilter struct {
+	minimum     int
+	pattern     *regexp.Regexp // the first group, or whole match, is the level
+	field       string         // the JSON field holding the level, if set
+	dropUnknown bool           // drops lines with no recognizable level
+}
+
+// returns a levelFilter for the route's minimum level, or nil if none is set
+func newLevelFilter(route *router.Route) (*levelFilter, error) {
+	minimum := routeOption(route, `LOGSPOUT_CLOUDWATCH_MIN_LEVEL`, "")
+	if minimum == "" {
+		return nil, nil
+	}
+	severity, err := parseLevel(minimum)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := regexp.Compile(routeOption(route,
+		`LOGSPOUT_CLOUDWATCH_LEVEL_PATTERN`, DEFAULT_LEVEL_PATTERN))
+	if err != nil {
+		return nil, err
+	}
+	return &levelFilter{
+		minimum: severity,
+		pattern: pattern,
+		field:   routeOption(route, `LOGSPOUT_CLOUDWATCH_LEVEL_FIELD`, ""),
+		dropUnknown: routeOption(route, `LOGSPOUT_CLOUDWATCH_UNKNOWN_LEVEL`,
+			UNKNOWN_LEVEL_KEEP) == UNKNOWN_LEVEL_DROP,
+	}, nil
+}
+
+// returns the severity of a level name, in any case
+func parseLevel(name string) (int, error) {
+	severity, exists := levels[strings.ToLower(name)]
+	if !exists {
+		return 0, fmt.Errorf("unknown level %s", name)
+	}
+	return severity, nil
+}
+
+// returns whether a line should be kept: if its level is at least the
+// minimum, or if it has no recognizable level and those are kept.
+func (f *levelFilter) keep(line string) bool {
+	severity, err := parseLevel(f.level(line))
+	if err != nil {
+		return !f.dropUnknown
+	}
+	return severity >= f.minimum
+}
+
+// returns the level named in a line, or an empty string if none is found
+func (f *levelFilter) level(line string) string {
+	if f.field != "" && strings.HasPrefix(strings.TrimSpace(line), `{`) {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(line), &fields) == nil {
+			if level, isString := fields[f.field].(string); isString {
+				return level
+			}
+			return ""
+		}
+	}
+	match := f.pattern.FindStringSubmatch(line)
+	if len(match) > 1 {
+		return match[1]
+	}
+	if len(match) == 1 {
+		return match[0]
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const LIFECYCLE_BUFFER = 16 // events waiting to be written
+
+// when the Docker client stops delivering events, such as while the daemon
+// restarts, they are subscribed to again after this long, doubling after
+// each failure up to the maximum
+const EVENTS_RETRY_DELAY = time.Second
+const EVENTS_MAX_RETRY_DELAY = time.Minute
+
+// a subscription to Docker events, for lifecycle events and crash context
+type eventSubscription struct {
+	events chan *docker.APIEvents // nil while not subscribed
+	retry  <-chan time.Time       // fires when it is time to subscribe again
+	delay  time.Duration          // the last wait to subscribe again, if any
+}
+
+// drops the subscription, and schedules the next, waiting twice as long as
+// last time, until an event arrives
+func (s *eventSubscription) retryLater() {
+	s.delay *= 2
+	if s.delay == 0 {
+		s.delay = EVENTS_RETRY_DELAY
+	} else if s.delay > EVENTS_MAX_RETRY_DELAY {
+		s.delay = EVENTS_MAX_RETRY_DELAY
+	}
+	s.events, s.retry = nil, time.After(s.delay)
+}
+
+// records that the subscription delivered an event, so is working again
+func (s *eventSubscription) received() {
+	if s.delay > 0 {
+		log.Println("cloudwatch: receiving Docker events again")
+		s.delay = 0
+	}
+}
+
+// the Docker container events that LOGSPOUT_CLOUDWATCH_LIFECYCLE_EVENTS can
+// write to a container's stream, and how each is described
+var lifecycleEvents = map[string]func(*docker.APIEvents) string{
+	`stop`: func(event *docker.APIEvents) string { return "stopped" },
+	`die`: func(event *docker.APIEvents) string {
+		return "exited with code " + event.Actor.Attributes[`exitCode`]
+	},
+	`oom`: func(event *docker.APIEvents) string { return "ran out of memory" },
+}
+
+// returns the set of lifecycle events named in a comma-separated list
+func parseLifecycleEvents(text string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(text, `,`) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, exists := lifecycleEvents[name]; !exists {
+			return nil, fmt.Errorf("unknown lifecycle event %s", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// subscribes to Docker events, if any lifecycle events are enabled, crash
+// context is kept, or start banners are sent (to forget dead containers'
+// banners). A failed subscription is tried again later, backing off,
+// so lifecycle events resume once Docker does; until then, the subscription
+// never delivers.
+func (a *CloudwatchAdapter) subscribe(s *eventSubscription) {
+	s.retry = nil
+	if len(a.lifecycle) == 0 && a.crashLines <= 0 && !a.startBanners {
+		return
+	}
+	events := make(chan *docker.APIEvents, LIFECYCLE_BUFFER)
+	if err := a.client.AddEventListener(events); err != nil {
+		s.retryLater()
+		log.Printf("cloudwatch: WARNING not listening for lifecycle events, "+
+			"trying again in %s: %s\n", s.delay, err)
+		return
+	}
+	s.events = events
+}
+
+// stops listening for Docker events
+func (a *CloudwatchAdapter) unsubscribe(s *eventSubscription) {
+	if s.events != nil {
+		a.client.RemoveEventListener(s.events)
+	}
+}
+
+// forgets that a container's start was announced when it dies, so that the
+// banners of past containers don't accumulate. If it is started again, the
+// new start is announced.
+func (a *CloudwatchAdapter) forgetBanner(event *docker.APIEvents) {
+	if event.Type == `container` && event.Action == `die` {
+		delete(a.bannered, event.Actor.ID)
+	}
+}
+
+// writes an enabled lifecycle event to its container's streams, if the
+// container's names are cached. Events for containers that have not logged
+// anything yet are ignored, as there is no stream to put them in.
+func (a *CloudwatchAdapter) sendLifecycle(event *docker.APIEvents) {
+	if event.Type != `container` || !a.lifecycle[event.Action] {
+		return
+	}
+	attributes := event.Actor.Attributes
+	container := &docker.Container{
+		ID:     event.Actor.ID,
+		Name:   attributes[`name`],
+		Config: &docker.Config{Labels: attributes},
+	}
+	key := a.containerKey(container)
+	if _, cached := a.groupnames[key]; !cached {
+		return
+	}
+	a.deliver(CloudwatchMessage{
+		Message: fmt.Sprintf("logspout: container %s (%s) %s",
+			attributes[`name`], container.ID,
+			lifecycleEvents[event.Action](event)),
+		Group:     a.groupnames[key],
+		Stream:    a.streamnames[key],
+		Time:      time.Now(),
+		Container: key,
+
+		ContainerName: attributes[`name`],
+		ContainerID:   container.ID,
+		Label:         a.errorLabel(container),
+		Attributes:    a.attributes[key],
+	})
+}
@@ -0,0 +1,139 @@
+package cloudwatch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// returns an adapter that keeps crash context, and writes it to the
+// diagnostics group, and the channel its messages are batched on
+func newCrashAdapter(lines int) (*CloudwatchAdapter, chan CloudwatchMessage) {
+	input := make(chan CloudwatchMessage, 16)
+	return &CloudwatchAdapter{
+		batcher: &CloudwatchBatcher{Input: input,
+			uploader: &CloudwatchUploader{diagnosticsGroup: `diagnostics`}},
+		cacheKey:     CACHE_KEY_ID,
+		crashLines:   lines,
+		crashBuffers: map[string][]CloudwatchMessage{},
+		groupnames:   map[string]string{},
+		streamnames:  map[string]string{},
+		fanouts:      map[string][]streamID{},
+		prefixes:     map[string]string{},
+		stderrgroups: map[string]string{},
+	}, input
+}
+
+// returns a Docker event for a container dying with the given exit code
+func dieEvent(id, exitCode string) *docker.APIEvents {
+	return &docker.APIEvents{Type: `container`, Action: `die`,
+		Actor: docker.APIActor{ID: id,
+			Attributes: map[string]string{`name`: `web`, `exitCode`: exitCode}}}
+}
+
+func TestCrashContextReplaysOnDie(t *testing.T) {
+	a, input := newCrashAdapter(2)
+	for _, text := range []string{`one`, `two`, `three`} {
+		a.bufferCrashLine(CloudwatchMessage{Message: text, Group: `app`,
+			Stream: `web`, Container: `abc`})
+	}
+	a.replayCrash(dieEvent(`abc`, `1`))
+	close(input)
+	replayed := []string{}
+	for msg := range input {
+		if msg.Group != `diagnostics` || msg.Stream != `web` {
+			t.Errorf("replayed to %s-%s, want diagnostics-web", msg.Group, msg.Stream)
+		}
+		replayed = append(replayed, msg.Message)
+	}
+	if len(replayed) != 2 || replayed[0] != `two` || replayed[1] != `three` {
+		t.Errorf("replayed %v, want the last 2 lines", replayed)
+	}
+	if len(a.crashBuffers) != 0 {
+		t.Error("the buffer was kept after the container died")
+	}
+}
+
+func TestForgetDiscardsCrashContext(t *testing.T) {
+	a, _ := newCrashAdapter(2)
+	a.bufferCrashLine(CloudwatchMessage{Message: `one`, Container: `abc`})
+	a.forget(`abc`)
+	if len(a.crashBuffers) != 0 {
+		t.Error("the buffer of a forgotten container was kept")
+	}
+}
+
+func TestLostDockerEventsAreSubscribedAgain(t *testing.T) {
+	subscriptions := int32(0)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/events` { // ends at once, as if the daemon stopped
+			atomic.AddInt32(&subscriptions, 1)
+		}
+	}))
+	defer daemon.Close()
+	t.Setenv(`DOCKER_HOST`, daemon.URL)
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`LOGSPOUT_CLOUDWATCH_LIFECYCLE_EVENTS`: `die`})
+	logstream := make(chan *router.Message)
+	defer close(logstream)
+	go a.Stream(logstream)
+	f.await(t, "Docker events to be subscribed to again", func() bool {
+		return atomic.LoadInt32(&subscriptions) >= 2
+	})
+}
+
+func TestEventSubscriptionBacksOff(t *testing.T) {
+	s := &eventSubscription{}
+	delays := []time.Duration{}
+	for i := 0; i < 8; i++ {
+		s.retryLater()
+		delays = append(delays, s.delay)
+	}
+	if delays[0] != EVENTS_RETRY_DELAY || delays[1] != 2*EVENTS_RETRY_DELAY ||
+		delays[7] != EVENTS_MAX_RETRY_DELAY {
+		t.Errorf("waited %v, want doubling delays up to the maximum", delays)
+	}
+	s.received()
+	if s.retryLater(); s.delay != EVENTS_RETRY_DELAY {
+		t.Errorf("waited %s after events resumed, want the initial delay", s.delay)
+	}
+}
+
+func TestDieEventIsLogged(t *testing.T) {
+	a, input := newCrashAdapter(0)
+	a.lifecycle = map[string]bool{`die`: true}
+	a.groupnames[`abc`], a.streamnames[`abc`] = `app`, `web`
+	a.sendLifecycle(dieEvent(`abc`, `137`))
+	a.sendLifecycle(dieEvent(`unknown`, `1`)) // has no stream yet
+	close(input)
+	events := []CloudwatchMessage{}
+	for msg := range input {
+		events = append(events, msg)
+	}
+	if len(events) != 1 || events[0].Group != `app` || events[0].Stream != `web` ||
+		events[0].Message != `logspout: container web (abc) exited with code 137` {
+		t.Errorf("got %+v, want one event with the exit code", events)
+	}
+}
+
+func TestBannerIsForgottenOnDie(t *testing.T) {
+	a, input := newCrashAdapter(0)
+	a.startBanners, a.bannered = true, map[string]time.Time{}
+	a.groupnames[`abc`], a.streamnames[`abc`] = `app`, `web`
+	container := &docker.Container{ID: `abc`, Name: `/web`,
+		State: docker.State{StartedAt: time.Now()}}
+	a.sendBanner(`abc`, container)
+	a.sendBanner(`abc`, container)
+	if len(input) != 1 {
+		t.Errorf("sent %d banners for one start, want 1", len(input))
+	}
+	a.forgetBanner(dieEvent(`abc`, `0`))
+	if len(a.bannered) != 0 {
+		t.Error("the banner of a dead container is still remembered")
+	}
+}
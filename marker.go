@@ -0,0 +1,50 @@
+package cloudwatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// the most a batch marker's text can take up, which validate() leaves room
+// for in each batch when markers are enabled
+const MAX_MARKER_LENGTH = 256 // bytes
+
+// a marker event, written ahead of each batch's events when
+// LOGSPOUT_CLOUDWATCH_BATCH_MARKERS is set, so downstream verification can
+// detect events that were lost or altered
+type batchMarker struct {
+	Event  string `json:"event"`
+	Count  int    `json:"count"`  // the events that follow in the batch
+	SHA256 string `json:"sha256"` // of their timestamps and messages
+}
+
+// returns the size that a batch marker counts for against the batch limits
+func markerSize() int64 {
+	return msgSize(CloudwatchMessage{Message: strings.Repeat(" ", MAX_MARKER_LENGTH)})
+}
+
+// returns the marker event for a valid batch, timestamped with its first
+// event, so it stays in chronological order ahead of them. The hash covers
+// each event's timestamp in milliseconds and its message, one per line,
+// exactly as uploaded.
+func (b CloudwatchBatch) marker() *cloudwatchlogs.InputLogEvent {
+	hash := sha256.New()
+	for _, msg := range b.Msgs {
+		fmt.Fprintf(hash, "%d %s\n", msg.Time.UnixNano()/1000000, msg.Message)
+	}
+	encoded, _ := json.Marshal(batchMarker{
+		Event:  `batch_marker`,
+		Count:  len(b.Msgs),
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	})
+	return &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(string(encoded)),
+		Timestamp: aws.Int64(b.Msgs[0].Time.UnixNano() / 1000000),
+	}
+}
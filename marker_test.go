@@ -0,0 +1,43 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestMarkerCountsAndHashesBatch(t *testing.T) {
+	batch := NewCloudwatchBatch()
+	batch.Append(CloudwatchMessage{Message: `first`, Time: time.Unix(1, 0)})
+	batch.Append(CloudwatchMessage{Message: `second`, Time: time.Unix(2, 0)})
+	event := batch.marker()
+	marker := batchMarker{}
+	if err := json.Unmarshal([]byte(aws.StringValue(event.Message)), &marker); err != nil {
+		t.Fatal(err)
+	}
+	want := batchMarker{Event: `batch_marker`, Count: 2,
+		SHA256: `26672f7c19e4a15b97a7f8c578af78c2b2631e06dec718aef5c8ed9d73993203`}
+	if marker != want {
+		t.Errorf("got marker %+v, want %+v", marker, want)
+	}
+	if aws.Int64Value(event.Timestamp) != 1000 {
+		t.Errorf("marker is timestamped %d, want the first event's 1000",
+			aws.Int64Value(event.Timestamp))
+	}
+	if length := len(aws.StringValue(event.Message)); length > MAX_MARKER_LENGTH {
+		t.Errorf("marker of %d bytes is over MAX_MARKER_LENGTH", length)
+	}
+}
+
+func TestValidateReservesRoomForMarkers(t *testing.T) {
+	now := time.Now()
+	batches, _ := testBatch(now, MAX_BATCH_COUNT, `x`).validate(now, true)
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	if count := len(batches[0].Msgs); count+1 > MAX_BATCH_COUNT {
+		t.Errorf("first batch has %d messages, leaving no room for a marker", count)
+	}
+}
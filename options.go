@@ -0,0 +1,436 @@
+package cloudwatch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Returns the value of a host-wide (non-templated) option, read from the
+// OS environment and then the route options, or the default value if unset.
+func routeOption(route *router.Route, key, defaultVal string) string {
+	finalVal := defaultVal
+	if envVal := os.Getenv(key); envVal != "" {
+		finalVal = envVal
+	}
+	if routeOptionsVal, exists := route.Options[key]; exists {
+		finalVal = routeOptionsVal
+	}
+	return finalVal
+}
+
+// Returns whether a flag is set: present in the route options, even with no
+// value, as in ?LOGSPOUT_CLOUDWATCH_ADMIN, or set to anything in the OS
+// environment.
+func routeFlag(route *router.Route, key string) bool {
+	if _, exists := route.Options[key]; exists {
+		return true
+	}
+	return os.Getenv(key) != ""
+}
+
+// Returns a host-wide option parsed as an integer, or the default value
+// if the option is unset or cannot be parsed.
+func routeIntOption(route *router.Route, key string, defaultVal int) int {
+	text := routeOption(route, key, "")
+	if text == "" {
+		return defaultVal
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING error parsing %s %s, using default of %d\n",
+			key, text, defaultVal)
+		return defaultVal
+	}
+	return value
+}
+
+// Returns a host-wide option parsed as a duration (such as "500ms" or "5s"),
+// or the default value if the option is unset or cannot be parsed.
+func routeDurationOption(route *router.Route, key string,
+	defaultVal time.Duration) time.Duration {
+	text := routeOption(route, key, "")
+	if text == "" {
+		return defaultVal
+	}
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING error parsing %s %s, using default of %s\n",
+			key, text, defaultVal)
+		return defaultVal
+	}
+	return value
+}
+
+// Returns a host-wide option with any Go escape sequences (such as \x1e or
+// \n) interpreted, so control characters can be given in the environment.
+func routeEscapedOption(route *router.Route, key, defaultVal string) string {
+	text := routeOption(route, key, defaultVal)
+	if unquoted, err := strconv.Unquote(`"` + text + `"`); err == nil {
+		return unquoted
+	}
+	return text
+}
+
+// OPTION VALIDATION
+
+// optionValidators check the value of each option that the adapter reads,
+// keyed by option name. Templated options are only checked for syntax, as
+// their values can't be known until a container's context is rendered.
+var optionValidators = map[string]func(string) error{
+	`DELAY`:                                        validatePositiveInt,
+	`LOGSPOUT_GROUP`:                               validateTemplate,
+	`LOGSPOUT_STREAM`:                              validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_RETENTION_DAYS`:           validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_LOG_CLASS`:                validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_CACHE_KEY`:                validateCacheKey,
+	`LOGSPOUT_CLOUDWATCH_RECORD_TIMEOUT`:           validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_RECORD_MAX_SIZE`:          validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_INSPECT_CONCURRENCY`:      validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_MULTILINE_MAX_LINES`:      validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_FANOUT`:                   validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_DOCKER_TIMEOUT`:           validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_DOCKER_FAILURES`:          validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_DOCKER_COOLDOWN`:          validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_GROUP_CHARS`:              validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_STREAM_CHARS`:             validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_UNNAMED_STREAM`:           validateUnnamedStream,
+	`LOGSPOUT_CLOUDWATCH_ADAPTIVE_MIN_EVENTS`:      validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_ADAPTIVE_MAX_AGE`:         validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_AWS_DEBUG`:                validateAWSLogLevel,
+	`LOGSPOUT_CLOUDWATCH_CREATE_WAIT`:              validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_HEALTHCHECK_PATTERN`:      validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_COALESCE_DELAY`:           validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_AWS_MAX_RETRIES`:          validateNonNegativeInt,
+	`LOGSPOUT_CLOUDWATCH_BACKLOG_GRACE`:            validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_PREFIX`:                   validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_ON_ACCESS_DENIED`:         validateAccessDeniedPolicy,
+	`LOGSPOUT_CLOUDWATCH_ACCESS_DENIED_INTERVAL`:   validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_QUEUED_BATCHES`:           validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_STDERR_GROUP`:             validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_STDERR_RETENTION_DAYS`:    validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_JSON_FIELDS`:              validateJSONFields,
+	`LOGSPOUT_CLOUDWATCH_DOCKER_MAX_COOLDOWN`:      validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_REJECTED_REDACT`:          validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_ON_PAUSE`:                 validatePausePolicy,
+	`LOGSPOUT_CLOUDWATCH_GROUP_CASE`:               validateCase,
+	`LOGSPOUT_CLOUDWATCH_MAX_IDLE_CONNS`:           validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_MAX_IDLE_CONNS_PER_HOST`:  validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_IDLE_CONN_TIMEOUT`:        validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_KEEP_ALIVE`:               validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_LIFECYCLE_EVENTS`:         validateLifecycleEvents,
+	`LOGSPOUT_CLOUDWATCH_STREAM_BUCKET`:            validateStreamBucket,
+	`LOGSPOUT_CLOUDWATCH_SEND_TIMEOUT`:             validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_CHECKPOINT_INTERVAL`:      validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_MIN_LEVEL`:                validateLevel,
+	`LOGSPOUT_CLOUDWATCH_LEVEL_PATTERN`:            validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_UNKNOWN_LEVEL`:            validateUnknownLevel,
+	`LOGSPOUT_CLOUDWATCH_FLUSH_ALIGN`:              validateFlushAlign,
+	`LOGSPOUT_CLOUDWATCH_HOST_SOURCE`:              validateHostSource,
+	`LOGSPOUT_CLOUDWATCH_CRASH_LINES`:              validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_DESCRIBE_RETRIES`:         validateNonNegativeInt,
+	`LOGSPOUT_CLOUDWATCH_STREAM_HEADER`:            validateTemplate,
+	`LOGSPOUT_CLOUDWATCH_ROLE_DURATION`:            validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_ROLE_RENEWAL`:             validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_EXCLUDE_IMAGES`:           validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_BODY_TIMEZONE`:            validateLocation,
+	`LOGSPOUT_CLOUDWATCH_EVENTS_PER_SECOND`:        validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_PACE_MAX_AGE`:             validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_TRANSFORMS`:               validateTransforms,
+	`LOGSPOUT_CLOUDWATCH_REDACT_PATTERN`:           validateRegexp,
+	`LOGSPOUT_CLOUDWATCH_CONTAINER_QUEUED_BATCHES`: validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_EMPTY_BATCH_WARNING`:      validateNonNegativeInt,
+	`LOGSPOUT_CLOUDWATCH_GROUP_EXPR`:               validateRoutingExpr,
+	`LOGSPOUT_CLOUDWATCH_STREAM_EXPR`:              validateRoutingExpr,
+	`LOGSPOUT_CLOUDWATCH_PUTLOGEVENTS_TPS`:         validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_TEE`:                      validateTee,
+	`LOGSPOUT_CLOUDWATCH_ALREADY_EXISTS`:           validateAlreadyExists,
+	`LOGSPOUT_CLOUDWATCH_SPLIT_ON_CONFLICTS`:       validatePositiveInt,
+	`LOGSPOUT_CLOUDWATCH_TIMESTAMPS`:               validateTimestamps,
+	`LOGSPOUT_CLOUDWATCH_GROUP_CREATE_WAIT`:        validatePositiveDuration,
+	`LOGSPOUT_CLOUDWATCH_ON_BLANK_NAME`:            validateBlankName,
+	`LOGSPOUT_CLOUDWATCH_MAX_MESSAGE_LENGTH`:       validatePositiveInt,
+	// options that take any value, and flags, which are set by being present
+	`DEBUG`:                                   validateAny,
+	`NOEC2`:                                   validateAny,
+	`LOGSPOUT_CLOUDWATCH_ACCOUNT_ID`:          validateAny,
+	`LOGSPOUT_CLOUDWATCH_ADMIN`:               validateAny,
+	`LOGSPOUT_CLOUDWATCH_ARRIVAL_ORDER`:       validateAny,
+	`LOGSPOUT_CLOUDWATCH_BATCH_MARKERS`:       validateAny,
+	`LOGSPOUT_CLOUDWATCH_BODY_TIMESTAMP`:      validateAny,
+	`LOGSPOUT_CLOUDWATCH_CHECK_TEMPLATES`:     validateAny,
+	`LOGSPOUT_CLOUDWATCH_DELIVERY_LATENCY`:    validateAny,
+	`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_GROUP`:   validateAny,
+	`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_STREAM`:  validateAny,
+	`LOGSPOUT_CLOUDWATCH_DROP_HEALTHCHECKS`:   validateAny,
+	`LOGSPOUT_CLOUDWATCH_ENDPOINT`:            validateAny,
+	`LOGSPOUT_CLOUDWATCH_ERROR_LABEL`:         validateAny,
+	`LOGSPOUT_CLOUDWATCH_ERROR_METRICS_ONLY`:  validateAny,
+	`LOGSPOUT_CLOUDWATCH_FALLBACK_STREAM`:     validateAny,
+	`LOGSPOUT_CLOUDWATCH_INSTANCE_ID`:         validateAny,
+	`LOGSPOUT_CLOUDWATCH_INSTANCE_TAGS`:       validateAny,
+	`LOGSPOUT_CLOUDWATCH_JSON`:                validateAny,
+	`LOGSPOUT_CLOUDWATCH_JSON_ENV`:            validateAny,
+	`LOGSPOUT_CLOUDWATCH_JSON_LABELS`:         validateAny,
+	`LOGSPOUT_CLOUDWATCH_JSON_TOP_LEVEL`:      validateAny,
+	`LOGSPOUT_CLOUDWATCH_LEVEL_FIELD`:         validateAny,
+	`LOGSPOUT_CLOUDWATCH_LOG_REJECTED`:        validateAny,
+	`LOGSPOUT_CLOUDWATCH_MULTILINE_SEPARATOR`: validateAny,
+	`LOGSPOUT_CLOUDWATCH_NAME_REPLACEMENT`:    validateAny,
+	`LOGSPOUT_CLOUDWATCH_RECORD_TERMINATOR`:   validateAny,
+	`LOGSPOUT_CLOUDWATCH_REGION`:              validateAny,
+	`LOGSPOUT_CLOUDWATCH_SKIP_BACKLOG`:        validateAny,
+	`LOGSPOUT_CLOUDWATCH_SKIP_EC2_METADATA`:   validateAny,
+	`LOGSPOUT_CLOUDWATCH_SPLIT_STDERR`:        validateAny,
+	`LOGSPOUT_CLOUDWATCH_START_BANNER`:        validateAny,
+	`LOGSPOUT_CLOUDWATCH_TOKEN_FILE`:          validateAny,
+	`LOGSPOUT_CLOUDWATCH_USER_AGENT`:          validateAny,
+}
+
+// the templated options, which are also rendered for a sample container when
+// LOGSPOUT_CLOUDWATCH_CHECK_TEMPLATES is set
+var templatedOptions = map[string]bool{
+	`LOGSPOUT_GROUP`:                            true,
+	`LOGSPOUT_STREAM`:                           true,
+	`LOGSPOUT_CLOUDWATCH_RETENTION_DAYS`:        true,
+	`LOGSPOUT_CLOUDWATCH_LOG_CLASS`:             true,
+	`LOGSPOUT_CLOUDWATCH_FANOUT`:                true,
+	`LOGSPOUT_CLOUDWATCH_PREFIX`:                true,
+	`LOGSPOUT_CLOUDWATCH_STDERR_GROUP`:          true,
+	`LOGSPOUT_CLOUDWATCH_STDERR_RETENTION_DAYS`: true,
+}
+
+// Checks every option set in the OS environment or the route options, so
+// configuration mistakes are reported when the adapter starts, rather than
+// when a message first needs them. All problems are returned in one error.
+func validateOptions(route *router.Route) error {
+	checkTemplates := routeFlag(route, `LOGSPOUT_CLOUDWATCH_CHECK_TEMPLATES`)
+	keys := []string{}
+	for key := range optionValidators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	problems := []string{}
+	for _, key := range keys {
+		values := map[string]string{}
+		if envVal := os.Getenv(key); envVal != "" {
+			values[`environment`] = envVal
+		}
+		if routeOptionsVal, exists := route.Options[key]; exists {
+			values[`route option`] = routeOptionsVal
+		}
+		validate := optionValidators[key]
+		if checkTemplates && templatedOptions[key] {
+			validate = validateRendering
+		}
+		for source, value := range values {
+			if err := validate(value); err != nil {
+				problems = append(problems,
+					fmt.Sprintf("%s %s=%q: %s", source, key, value, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("cloudwatch: invalid configuration:\n  %s",
+			strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateAny(value string) error {
+	return nil
+}
+
+func validatePositiveInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	if number <= 0 {
+		return errors.New("must be greater than zero")
+	}
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	if number < 0 {
+		return errors.New("must not be negative")
+	}
+	return nil
+}
+
+func validatePositiveDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New(`not a duration, such as "500ms" or "5s"`)
+	}
+	if duration <= 0 {
+		return errors.New("must be greater than zero")
+	}
+	return nil
+}
+
+func validateRegexp(value string) error {
+	_, err := regexp.Compile(value)
+	return err
+}
+
+func validateTemplate(value string) error {
+	_, err := template.New("template").Parse(value)
+	return err
+}
+
+// checks that a template can be rendered, as well as parsed, by rendering
+// it for a sample container, so references to fields that don't exist are
+// caught. Any label is found on the sample container.
+func validateRendering(value string) error {
+	parsed, err := template.New("template").Parse(value)
+	if err != nil {
+		return err
+	}
+	return parsed.Execute(io.Discard, sampleRenderContext())
+}
+
+func validateUnnamedStream(value string) error {
+	if value != UNNAMED_STREAM_SHORT_ID && value != UNNAMED_STREAM_ID {
+		return fmt.Errorf("must be %s or %s", UNNAMED_STREAM_SHORT_ID, UNNAMED_STREAM_ID)
+	}
+	return nil
+}
+
+func validateAWSLogLevel(value string) error {
+	_, err := parseAWSLogLevel(value)
+	return err
+}
+
+func validateCacheKey(value string) error {
+	if !validCacheKey(value) {
+		return fmt.Errorf("must be %s, %s, %s or %s<name>",
+			CACHE_KEY_ID, CACHE_KEY_NAME, CACHE_KEY_SERVICE, CACHE_KEY_LABEL)
+	}
+	return nil
+}
+
+func validateAccessDeniedPolicy(value string) error {
+	if value != ACCESS_DENIED_RETRY && value != ACCESS_DENIED_DROP {
+		return fmt.Errorf("must be %s or %s", ACCESS_DENIED_RETRY, ACCESS_DENIED_DROP)
+	}
+	return nil
+}
+
+func validateJSONFields(value string) error {
+	_, err := parseJSONFields(value)
+	return err
+}
+
+func validatePausePolicy(value string) error {
+	if value != PAUSE_HOLD && value != PAUSE_DROP {
+		return fmt.Errorf("must be %s or %s", PAUSE_HOLD, PAUSE_DROP)
+	}
+	return nil
+}
+
+func validateCase(value string) error {
+	if value != CASE_LOWER && value != CASE_UPPER {
+		return fmt.Errorf("must be %s or %s", CASE_LOWER, CASE_UPPER)
+	}
+	return nil
+}
+
+func validateLifecycleEvents(value string) error {
+	_, err := parseLifecycleEvents(value)
+	return err
+}
+
+func validateStreamBucket(value string) error {
+	if _, exists := streamBuckets[value]; !exists {
+		return errors.New("must be hour or day")
+	}
+	return nil
+}
+
+func validateLevel(value string) error {
+	_, err := parseLevel(value)
+	return err
+}
+
+func validateUnknownLevel(value string) error {
+	if value != UNKNOWN_LEVEL_KEEP && value != UNKNOWN_LEVEL_DROP {
+		return fmt.Errorf("must be %s or %s", UNKNOWN_LEVEL_KEEP, UNKNOWN_LEVEL_DROP)
+	}
+	return nil
+}
+
+func validateTimestamps(value string) error {
+	if value != TIMESTAMPS_RECEIVED && value != TIMESTAMPS_FLUSHED {
+		return fmt.Errorf("must be %s or %s", TIMESTAMPS_RECEIVED, TIMESTAMPS_FLUSHED)
+	}
+	return nil
+}
+
+func validateFlushAlign(value string) error {
+	if value != ALIGN_CLOCK && value != ALIGN_JITTER {
+		return fmt.Errorf("must be %s or %s", ALIGN_CLOCK, ALIGN_JITTER)
+	}
+	return nil
+}
+
+func validateHostSource(value string) error {
+	if value != HOST_SOURCE_CONTAINER && value != HOST_SOURCE_LOGGER &&
+		value != HOST_SOURCE_INSTANCE {
+		return fmt.Errorf("must be %s, %s or %s",
+			HOST_SOURCE_CONTAINER, HOST_SOURCE_LOGGER, HOST_SOURCE_INSTANCE)
+	}
+	return nil
+}
+
+func validateLocation(value string) error {
+	_, err := time.LoadLocation(value)
+	return err
+}
+
+func validateTransforms(value string) error {
+	_, err := parseTransforms(value)
+	return err
+}
+
+func validateRoutingExpr(value string) error {
+	_, err := compileRoutingExpr(value)
+	return err
+}
+
+func validateTee(value string) error {
+	if value != TEE_STDOUT && value != TEE_SYSLOG {
+		return fmt.Errorf("must be %s or %s", TEE_STDOUT, TEE_SYSLOG)
+	}
+	return nil
+}
+
+func validateAlreadyExists(value string) error {
+	if value != ALREADY_EXISTS_IGNORE && value != ALREADY_EXISTS_ERROR {
+		return fmt.Errorf("must be %s or %s", ALREADY_EXISTS_IGNORE, ALREADY_EXISTS_ERROR)
+	}
+	return nil
+}
+
+func validateBlankName(value string) error {
+	if value != BLANK_NAME_DROP && value != BLANK_NAME_SEND {
+		return fmt.Errorf("must be %s or %s", BLANK_NAME_DROP, BLANK_NAME_SEND)
+	}
+	return nil
+}
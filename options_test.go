@@ -0,0 +1,45 @@
+package cloudwatch
+
+import (
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+func TestRouteOption(t *testing.T) {
+	const key = `LOGSPOUT_CLOUDWATCH_TEST_OPTION`
+	route := &router.Route{Options: map[string]string{}}
+	if value := routeOption(route, key, `default`); value != `default` {
+		t.Errorf("unset option is %q, want the default", value)
+	}
+	t.Setenv(key, `env`)
+	if value := routeOption(route, key, `default`); value != `env` {
+		t.Errorf("option set in the environment is %q, want env", value)
+	}
+	route.Options[key] = `route`
+	if value := routeOption(route, key, `default`); value != `route` {
+		t.Errorf("option set for the route is %q, want the route's value", value)
+	}
+}
+
+func TestRouteFlag(t *testing.T) {
+	const key = `LOGSPOUT_CLOUDWATCH_TEST_FLAG`
+	for _, test := range []struct {
+		name    string
+		options map[string]string
+		env     string
+		want    bool
+	}{
+		{"unset", map[string]string{}, "", false},
+		{"bare route option", map[string]string{key: ""}, "", true},
+		{"route option with a value", map[string]string{key: "true"}, "", true},
+		{"environment", map[string]string{}, "1", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(key, test.env)
+			if got := routeFlag(&router.Route{Options: test.options}, key); got != test.want {
+				t.Errorf("routeFlag is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
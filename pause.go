@@ -0,0 +1,108 @@
+package cloudwatch
+
+import (
+	"net/http"
+	"sort"
+)
+
+// LOGSPOUT_CLOUDWATCH_ON_PAUSE policies
+const PAUSE_HOLD = "hold" // keep batches for paused groups, up to a limit
+const PAUSE_DROP = "drop" // drop batches for paused groups
+
+// a request to pause or resume uploads to a log group, answered with the
+// groups that are paused afterwards
+type pauseRequest struct {
+	Group  string
+	Paused bool
+	done   chan []string
+}
+
+// AdapterPaused lists the log groups paused for a CloudwatchAdapter.
+type AdapterPaused struct {
+	Route  string   `json:"route"`
+	Groups []string `json:"paused_groups"`
+}
+
+// pauses or resumes uploads to the given log group, from any goroutine, and
+// returns the groups that are paused afterwards.
+func (u *CloudwatchUploader) pause(group string, paused bool) []string {
+	done := make(chan []string)
+	u.pauses <- pauseRequest{Group: group, Paused: paused, done: done}
+	return <-done
+}
+
+// a channel that is always ready to receive from
+var alwaysReady = func() chan bool {
+	ready := make(chan bool)
+	close(ready)
+	return ready
+}()
+
+// handles a pause request in the uploader's goroutine. Batches held while a
+// group was paused are queued to be uploaded when it resumes, one at a time
+// in between the uploader's other work, so the request is answered at once.
+func (u *CloudwatchUploader) setPaused(request pauseRequest) {
+	if request.Paused {
+		u.paused[request.Group] = true
+	} else if u.paused[request.Group] {
+		delete(u.paused, request.Group)
+		u.resumed = append(u.resumed, u.held[request.Group]...)
+		delete(u.held, request.Group)
+	}
+	groups := []string{}
+	for group := range u.paused {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	request.done <- groups
+}
+
+// returns a channel that is ready while resumed batches wait to be
+// uploaded, or nil, which never is
+func (u *CloudwatchUploader) resuming() <-chan bool {
+	if len(u.resumed) == 0 {
+		return nil
+	}
+	return alwaysReady
+}
+
+// holds or drops a batch for a paused group, according to the pause policy.
+// No more batches are held for each group than may be queued for upload.
+func (u *CloudwatchUploader) holdBatch(batch CloudwatchBatch) {
+	group := batch.Msgs[0].Group
+	if u.pausePolicy == PAUSE_HOLD && len(u.held[group]) < u.queueLimit {
+		u.held[group] = append(u.held[group], batch)
+		return
+	}
+	u.adapter.stats.Add(`paused_dropped`, int64(len(batch.Msgs)))
+	u.reportDrop(batch, `paused`)
+}
+
+// returns a handler that pauses, or resumes, uploads to the log group named
+// by the "group" query parameter, for every adapter with the admin endpoints
+// enabled.
+func pauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		group := r.URL.Query().Get(`group`)
+		if group == "" {
+			http.Error(w, "the group parameter is required", http.StatusBadRequest)
+			return
+		}
+		list := adminAdapters(w)
+		if list == nil {
+			return
+		}
+		results := []AdapterPaused{}
+		for _, adapter := range list {
+			results = append(results, AdapterPaused{
+				Route:  adapter.Route.ID,
+				Groups: adapter.batcher.uploader.pause(group, paused),
+			})
+		}
+		writeJSON(w, results)
+	}
+}
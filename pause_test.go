@@ -0,0 +1,58 @@
+package cloudwatch
+
+import (
+	"testing"
+	"time"
+)
+
+// returns the number of batches held for a stream while its group is paused
+func heldBatches(a *CloudwatchAdapter, group, stream string) int {
+	for _, snapshot := range a.Snapshot().Streams {
+		if snapshot.Group == group && snapshot.Stream == stream {
+			return snapshot.HeldBatches
+		}
+	}
+	return 0
+}
+
+func TestPausedGroupIsHeldUntilResumed(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`})
+	u := a.batcher.uploader
+	if paused := u.pause(`g`, true); len(paused) != 1 || paused[0] != `g` {
+		t.Fatalf("paused %v, want g", paused)
+	}
+	a.batcher.Input <- CloudwatchMessage{Message: `held`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	a.batcher.Input <- CloudwatchMessage{Message: `other`, Group: `other`, Stream: `s`,
+		Time: time.Now()}
+	f.await(t, "the batch to be held", func() bool { return heldBatches(a, `g`, `s`) == 1 })
+	f.await(t, "the other group", func() bool { return len(f.messages(`other`, `s`)) == 1 })
+	if len(f.messages(`g`, `s`)) != 0 {
+		t.Fatal("uploaded to a paused group")
+	}
+	if paused := u.pause(`g`, false); len(paused) != 0 {
+		t.Errorf("still paused %v after resuming", paused)
+	}
+	f.await(t, "the held batch", func() bool { return len(f.messages(`g`, `s`)) == 1 })
+}
+
+func TestPausedGroupIsDropped(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_ON_PAUSE`: PAUSE_DROP})
+	u := a.batcher.uploader
+	u.pause(`g`, true)
+	a.batcher.Input <- CloudwatchMessage{Message: `dropped`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	f.await(t, "the batch to be dropped", func() bool {
+		return a.stats.Snapshot()[`paused_dropped`] == 1
+	})
+	u.pause(`g`, false)
+	a.batcher.Input <- CloudwatchMessage{Message: `resumed`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	f.await(t, "uploads after resuming", func() bool { return len(f.messages(`g`, `s`)) == 1 })
+	if messages := f.messages(`g`, `s`); messages[0] != `resumed` {
+		t.Errorf("uploaded %v, want only the message sent after resuming", messages)
+	}
+}
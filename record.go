@@ -0,0 +1,84 @@
+package cloudwatch
+
+import (
+	"strings"
+	"time"
+)
+
+// Defaults for reassembling records that span several Docker messages.
+const DEFAULT_RECORD_TIMEOUT = 5 * time.Second
+const DEFAULT_RECORD_MAX_SIZE = MAX_EVENT_SIZE - MSG_OVERHEAD // bytes, one event
+const DEFAULT_RECORD_SEPARATOR = "\n"
+
+// identifies the output a record is reassembled from: one of a container's
+// stdout and stderr, which are kept apart, as they may go to different
+// streams, and their lines interleave.
+type recordKey struct {
+	Container string // the container's cache key
+	Output    string
+}
+
+// returns the key of the record a message belongs to
+func (msg CloudwatchMessage) record() recordKey {
+	return recordKey{Container: msg.Container, Output: msg.Output}
+}
+
+// CloudwatchRecord holds a logical record that an application emits across
+// several Docker messages, until a message ending in the configured
+// terminator arrives, or the record times out or grows too large.
+type CloudwatchRecord struct {
+	Msg     CloudwatchMessage // the first message, holding the joined text
+	Prefix  string            // the container's prefix, added when it is sent
+	Lines   int               // how many messages have been joined
+	Started time.Time         // when the first message arrived
+}
+
+// returns the size of the record's text, once it is prefixed
+func (record *CloudwatchRecord) size() int {
+	return len(record.Prefix) + len(record.Msg.Message)
+}
+
+// adds a message to its output's pending record, and sends the record on
+// to the batcher once it is complete, with the container's prefix added to
+// the joined text. A record that would grow past the maximum size is sent
+// first, so memory stays bounded for each stream, and a record that reaches
+// the maximum line count (if set) is sent at once.
+func (a *CloudwatchAdapter) appendRecord(msg CloudwatchMessage, prefix string) {
+	key := msg.record()
+	record, exists := a.records[key]
+	if exists && (record.size()+len(a.recordSeparator)+
+		len(msg.Message)) > a.recordMaxSize {
+		a.sendRecord(key)
+		exists = false
+	}
+	if exists {
+		record.Msg.Message = record.Msg.Message + a.recordSeparator + msg.Message
+		record.Lines++
+	} else {
+		record = &CloudwatchRecord{Msg: msg, Prefix: prefix, Lines: 1,
+			Started: time.Now()}
+		a.records[key] = record
+	}
+	if strings.HasSuffix(msg.Message, a.recordTerminator) ||
+		record.size() >= a.recordMaxSize ||
+		(a.recordMaxLines > 0 && record.Lines >= a.recordMaxLines) {
+		a.sendRecord(key)
+	}
+}
+
+// sends any records that have been pending for longer than the record
+// timeout - or all pending records, if all is true.
+func (a *CloudwatchAdapter) flushRecords(all bool) {
+	for key, record := range a.records {
+		if all || time.Since(record.Started) >= a.recordTimeout {
+			a.sendRecord(key)
+		}
+	}
+}
+
+func (a *CloudwatchAdapter) sendRecord(key recordKey) {
+	if record, exists := a.records[key]; exists {
+		delete(a.records, key)
+		a.deliver(record.Msg.prefixed(record.Prefix))
+	}
+}
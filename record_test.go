@@ -0,0 +1,150 @@
+package cloudwatch
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// returns an adapter that reassembles records ending in terminator, and
+// the channel its messages are batched on
+func newRecordAdapter(terminator string) (*CloudwatchAdapter, chan CloudwatchMessage) {
+	input := make(chan CloudwatchMessage, 16)
+	return &CloudwatchAdapter{
+		batcher:          &CloudwatchBatcher{Input: input},
+		recordTerminator: terminator,
+		recordSeparator:  DEFAULT_RECORD_SEPARATOR,
+		recordMaxSize:    DEFAULT_RECORD_MAX_SIZE,
+		records:          map[recordKey]*CloudwatchRecord{},
+		blankPolicy:      BLANK_NAME_DROP,
+		stats:            NewCounters(),
+	}, input
+}
+
+func TestRecordsKeepOutputsApart(t *testing.T) {
+	a, input := newRecordAdapter(`END`)
+	line := func(output, group, text string) CloudwatchMessage {
+		return CloudwatchMessage{Message: text, Group: group, Stream: `web`,
+			Container: `abc`, Output: output}
+	}
+	a.appendRecord(line(`stdout`, `app`, `one`), ``)
+	a.appendRecord(line(`stderr`, `app-stderr`, `err-one`), ``)
+	a.appendRecord(line(`stdout`, `app`, `twoEND`), ``)
+	a.appendRecord(line(`stderr`, `app-stderr`, `err-twoEND`), ``)
+
+	expected := []CloudwatchMessage{
+		{Group: `app`, Message: "one\ntwoEND"},
+		{Group: `app-stderr`, Message: "err-one\nerr-twoEND"},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-input:
+			if got.Group != want.Group || got.Message != want.Message {
+				t.Errorf("got %q in %s, want %q in %s",
+					got.Message, got.Group, want.Message, want.Group)
+			}
+		default:
+			t.Fatalf("no record sent, want %q", want.Message)
+		}
+	}
+	if len(a.records) != 0 {
+		t.Errorf("%d records left pending, want none", len(a.records))
+	}
+}
+
+func TestRecordFlushSendsEachOutput(t *testing.T) {
+	a, input := newRecordAdapter(`END`)
+	a.appendRecord(CloudwatchMessage{Message: `out`, Group: `g`, Stream: `s`,
+		Container: `abc`, Output: `stdout`}, ``)
+	a.appendRecord(CloudwatchMessage{Message: `err`, Group: `g`, Stream: `s`,
+		Container: `abc`, Output: `stderr`}, ``)
+	a.flushRecords(true)
+	if len(input) != 2 {
+		t.Fatalf("flushed %d records, want 2", len(input))
+	}
+}
+
+func TestPrefixesOfContainersSharingAStream(t *testing.T) {
+	for _, terminator := range []string{``, `END`} {
+		a, input := newRecordAdapter(terminator)
+		a.groupnames = map[string]string{`web`: `app`, `worker`: `app`}
+		a.streamnames = map[string]string{`web`: `shared`, `worker`: `shared`}
+		a.prefixes = map[string]string{`web`: `[web] `, `worker`: `[worker] `}
+		line := func(name, text string) arrival {
+			return arrival{Message: &router.Message{Data: text, Source: `stdout`,
+				Container: &docker.Container{ID: name, Name: `/` + name}}}
+		}
+		a.send(line(`web`, `one`), `web`)
+		a.send(line(`worker`, `twoEND`), `worker`)
+		a.send(line(`web`, `threeEND`), `web`)
+		a.flushRecords(true)
+
+		want := map[string]bool{`[web] one`: true, `[worker] twoEND`: true,
+			`[web] threeEND`: true}
+		if terminator != `` {
+			want = map[string]bool{"[web] one\nthreeEND": true, `[worker] twoEND`: true}
+		}
+		close(input)
+		for msg := range input {
+			if msg.Stream != `shared` || !want[msg.Message] {
+				t.Errorf("with terminator %q, got %q in %s", terminator,
+					msg.Message, msg.Stream)
+			}
+			delete(want, msg.Message)
+		}
+		if len(want) != 0 {
+			t.Errorf("with terminator %q, %v were not sent", terminator, want)
+		}
+	}
+}
+
+func TestLongRecordSplitsAtMaxLines(t *testing.T) {
+	a, input := newRecordAdapter(`END`)
+	a.recordMaxLines = 3
+	for _, text := range []string{`a`, `b`, `c`, `d`, `e`, `f`, `g`} {
+		a.appendRecord(CloudwatchMessage{Message: text, Group: `g`, Stream: `s`,
+			Container: `abc`, Output: `stdout`}, ``)
+	}
+	a.flushRecords(true)
+	for _, want := range []string{"a\nb\nc", "d\ne\nf", "g"} {
+		select {
+		case got := <-input:
+			if got.Message != want {
+				t.Errorf("got %q, want %q", got.Message, want)
+			}
+		default:
+			t.Fatalf("no record sent, want %q", want)
+		}
+	}
+}
+
+func TestRecordSeparators(t *testing.T) {
+	for separator, want := range map[string]string{
+		DEFAULT_RECORD_SEPARATOR: "wrapped\ntext\nEND",
+		` `:                      "wrapped text END",
+		` | `:                    "wrapped | text | END",
+	} {
+		a, input := newRecordAdapter(`END`)
+		a.recordSeparator = separator
+		line := func(text string) CloudwatchMessage {
+			return CloudwatchMessage{Message: text, Group: `g`, Stream: `s`,
+				Container: `abc`}
+		}
+		a.appendRecord(line(`wrapped`), ``)
+		a.appendRecord(line(`text`), ``)
+		joined := len(`wrapped`) + len(separator) + len(`text`)
+		if size := a.records[recordKey{Container: `abc`}].size(); size != joined {
+			t.Errorf("%q: record of %d bytes is counted as %d", separator, joined, size)
+		}
+		a.appendRecord(line(`END`), ``)
+		select {
+		case got := <-input:
+			if got.Message != want {
+				t.Errorf("joined with %q into %q, want %q", separator, got.Message, want)
+			}
+		default:
+			t.Fatalf("no record sent, want %q", want)
+		}
+	}
+}
@@ -7,17 +7,126 @@ import (
 	"os"
 	"strings"
 	"text/template"
+
+	"github.com/fsouza/go-dockerclient"
 )
 
 type RenderContext struct {
-	Host       string            // container host name
-	Env        map[string]string // container ENV
-	Labels     map[string]string // container Labels
-	Name       string            // container Name
-	ID         string            // container ID
-	LoggerHost string            // hostname of logging container (os.Hostname)
-	InstanceID string            // EC2 Instance ID
-	Region     string            // EC2 region
+	Host         string            // container host name
+	Env          map[string]string // container ENV
+	Labels       map[string]string // container Labels
+	Name         string            // container Name
+	ID           string            // container ID
+	LoggerHost   string            // hostname of logging container (os.Hostname)
+	InstanceID   string            // EC2 Instance ID
+	Region       string            // EC2 region
+	AccountID    string            // AWS account ID of the credentials
+	InstanceTags map[string]string // EC2 instance tags, if fetched
+	Tag          string            // rendered Docker log tag (--log-opt tag=)
+	Command      string            // container entrypoint and command
+
+	// from the labels Kubernetes sets on a pod's containers, if any
+	PodName          string // io.kubernetes.pod.name
+	PodNamespace     string // io.kubernetes.pod.namespace
+	K8sContainerName string // io.kubernetes.container.name
+
+	sample bool // a sample context, for checking templates, has every label
+}
+
+// returns a RenderContext for a made-up container, used to check that
+// templates render when LOGSPOUT_CLOUDWATCH_CHECK_TEMPLATES is set
+func sampleRenderContext() *RenderContext {
+	return &RenderContext{
+		Host:         `sample-host`,
+		Env:          map[string]string{},
+		Labels:       map[string]string{},
+		Name:         `sample-container`,
+		ID:           strings.Repeat(`0123456789ab`, 5) + `cdef`,
+		LoggerHost:   `sample-logger-host`,
+		InstanceID:   `i-0123456789abcdef0`,
+		Region:       `us-east-1`,
+		AccountID:    `123456789012`,
+		InstanceTags: map[string]string{},
+		Tag:          `sample-tag`,
+		Command:      `sample-command`,
+		sample:       true,
+
+		PodName:          `sample-pod`,
+		PodNamespace:     `sample-namespace`,
+		K8sContainerName: `sample-container`,
+	}
+}
+
+// sets the context's Kubernetes fields from the labels the kubelet gives a
+// pod's containers. Containers not run by Kubernetes leave them empty.
+func (r *RenderContext) setKubernetesFields() {
+	r.PodName = r.Labels[`io.kubernetes.pod.name`]
+	r.PodNamespace = r.Labels[`io.kubernetes.pod.namespace`]
+	r.K8sContainerName = r.Labels[`io.kubernetes.container.name`]
+}
+
+// returns the container's entrypoint and command, joined by spaces, or an
+// empty string if neither is known
+func containerCommand(containerData *docker.Container) string {
+	if containerData.Config == nil {
+		return ""
+	}
+	command := append([]string{}, containerData.Config.Entrypoint...)
+	command = append(command, containerData.Config.Cmd...)
+	return strings.Join(command, " ")
+}
+
+// the fields available to a Docker log tag template, as documented at
+// https://docs.docker.com/config/containers/logging/log_tags/
+type dockerTagContext struct {
+	ID          string
+	FullID      string
+	Name        string
+	ImageID     string
+	ImageFullID string
+	ImageName   string
+	DaemonName  string
+}
+
+// renders the container's Docker log tag, set with --log-opt tag=, the same
+// way Docker does - or returns an empty string if no tag is set.
+func dockerTag(containerData *docker.Container) string {
+	if containerData.HostConfig == nil || containerData.Config == nil {
+		return ""
+	}
+	tag := containerData.HostConfig.LogConfig.Config[`tag`]
+	if tag == "" {
+		return ""
+	}
+	imageFullID := strings.TrimPrefix(containerData.Image, `sha256:`)
+	context := dockerTagContext{
+		ID:          shortID(containerData.ID),
+		FullID:      containerData.ID,
+		Name:        strings.TrimPrefix(containerData.Name, `/`),
+		ImageID:     shortID(imageFullID),
+		ImageFullID: imageFullID,
+		ImageName:   containerData.Config.Image,
+		DaemonName:  `docker`,
+	}
+	tagTemplate, err := template.New("tag").Parse(tag)
+	if err != nil {
+		log.Println("cloudwatch: error parsing Docker log tag", tag, ":", err)
+		return ""
+	}
+	var rendered bytes.Buffer
+	if err = tagTemplate.Execute(&rendered, context); err != nil {
+		log.Printf("cloudwatch: error rendering Docker log tag %s : %s\n", tag, err)
+		return ""
+	}
+	return rendered.String()
+}
+
+// returns the first SHORT_ID_LENGTH characters of an ID
+func shortID(id string) string {
+	if len(id) > SHORT_ID_LENGTH {
+		return id[:SHORT_ID_LENGTH]
+	}
+	return id
 }
 
 // renders a label value based on a given key
@@ -25,6 +134,9 @@ func (r *RenderContext) Lbl(key string) (string, error) {
 	if val, exists := r.Labels[key]; exists {
 		return val, nil
 	}
+	if r.sample {
+		return key, nil
+	}
 	return "", fmt.Errorf("ERROR reading container label %s", key)
 }
 
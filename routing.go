@@ -0,0 +1,63 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// routingExprs holds the compiled routing expressions that compute log
+// group and stream names, for routing too complex for templates, such as
+// branching on several labels. Either may be nil, to use the template.
+type routingExprs struct {
+	group  *vm.Program
+	stream *vm.Program
+}
+
+// compiles an expression that computes a name from a RenderContext, such as
+//
+//	Labels["team"] == "core" && Env["STAGE"] != "" ? "core-" + Env["STAGE"] : Name
+func compileRoutingExpr(text string) (*vm.Program, error) {
+	return expr.Compile(text, expr.Env(&RenderContext{}), expr.AsKind(reflect.String))
+}
+
+// compiles the route's group and stream expressions, if any are set
+func newRoutingExprs(route *router.Route) (routingExprs, error) {
+	exprs := routingExprs{}
+	var err error
+	if text := routeOption(route, `LOGSPOUT_CLOUDWATCH_GROUP_EXPR`, ""); text != "" {
+		if exprs.group, err = compileRoutingExpr(text); err != nil {
+			return exprs, fmt.Errorf("LOGSPOUT_CLOUDWATCH_GROUP_EXPR: %s", err)
+		}
+	}
+	if text := routeOption(route, `LOGSPOUT_CLOUDWATCH_STREAM_EXPR`, ""); text != "" {
+		if exprs.stream, err = compileRoutingExpr(text); err != nil {
+			return exprs, fmt.Errorf("LOGSPOUT_CLOUDWATCH_STREAM_EXPR: %s", err)
+		}
+	}
+	return exprs, nil
+}
+
+// returns the name that a routing expression computes in the given context,
+// or the default value if there is no expression, or it fails or computes
+// an empty name.
+func evalRoutingExpr(program *vm.Program, context *RenderContext,
+	defaultVal string) string {
+	if program == nil {
+		return defaultVal
+	}
+	result, err := expr.Run(program, context)
+	if err != nil {
+		log.Printf("cloudwatch: error evaluating routing expression for %s: %s\n",
+			context.Name, err)
+		return defaultVal
+	}
+	if name, _ := result.(string); name != "" {
+		return name
+	}
+	return defaultVal
+}
@@ -0,0 +1,70 @@
+package cloudwatch
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cloudwatch's own rules for log group and log stream names, from
+// https://docs.aws.amazon.com/AmazonCloudWatchLogs/latest/APIReference/API_CreateLogGroup.html
+const DEFAULT_GROUP_CHARS = `[.\-_/#A-Za-z0-9]`
+const DEFAULT_STREAM_CHARS = `[^:*]`
+const DEFAULT_NAME_REPLACEMENT = `_`
+const MAX_NAME_LENGTH = 512 // characters
+
+// LOGSPOUT_CLOUDWATCH_GROUP_CASE conversions
+const CASE_LOWER = "lower"
+const CASE_UPPER = "upper"
+
+// NameSanitizer replaces the characters in a log group or log stream name
+// that don't match its pattern of allowed characters, and optionally
+// converts names to one case, as names are case-sensitive.
+type NameSanitizer struct {
+	Allowed     *regexp.Regexp // matches a single allowed character
+	Replacement string         // replaces each disallowed character
+	Case        string         // CASE_LOWER, CASE_UPPER, or empty to keep
+}
+
+// compiles a NameSanitizer for the given pattern, which should match any
+// single allowed character, such as a character class like [A-Za-z0-9]
+func NewNameSanitizer(pattern, replacement string) (*NameSanitizer, error) {
+	allowed, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	return &NameSanitizer{Allowed: allowed, Replacement: replacement}, nil
+}
+
+// returns the name in the configured case, with each disallowed character
+// replaced, truncated to the maximum length Cloudwatch accepts.
+func (s *NameSanitizer) Sanitize(name string) string {
+	switch s.Case {
+	case CASE_LOWER:
+		name = strings.ToLower(name)
+	case CASE_UPPER:
+		name = strings.ToUpper(name)
+	}
+	var sanitized strings.Builder
+	for _, char := range name {
+		if s.Allowed.MatchString(string(char)) {
+			sanitized.WriteRune(char)
+		} else {
+			sanitized.WriteString(s.Replacement)
+		}
+	}
+	result := sanitized.String()
+	if utf8.RuneCountInString(result) > MAX_NAME_LENGTH {
+		result = string([]rune(result)[:MAX_NAME_LENGTH])
+	}
+	return result
+}
+
+// returns whether a sanitized name is empty, or made up entirely of
+// replacements, so nothing of the original name survived.
+func (s *NameSanitizer) Blank(name string) bool {
+	if s.Replacement != "" {
+		name = strings.ReplaceAll(name, s.Replacement, "")
+	}
+	return name == ""
+}
@@ -0,0 +1,64 @@
+package cloudwatch
+
+// how many batches may wait for the uploader, across all streams
+const DEFAULT_QUEUED_BATCHES = 10
+
+// Receives batches on the uploader's input channel, and queues them by log
+// stream, until there are LOGSPOUT_CLOUDWATCH_QUEUED_BATCHES in all. Queued
+// batches are sent on the scheduled channel taking each stream in turn, so
+// a stream that keeps filling batches can't hold up the uploads of others.
+// With a per-container limit, a container's batches beyond it are dropped,
+// so a runaway container can't take up the whole queue and block the rest.
+func (u *CloudwatchUploader) schedule(scheduled chan<- CloudwatchBatch) {
+	queues := map[streamID][]CloudwatchBatch{}
+	order := []streamID{} // streams with queued batches, in the order to send
+	queued := 0
+	byContainer := map[string]int{} // queued batches, by container
+	for {
+		input := u.Input
+		if queued >= u.queueLimit { // wait for the uploader to catch up
+			input = nil
+		}
+		var next CloudwatchBatch
+		var output chan<- CloudwatchBatch // only set when there is a batch
+		if len(order) > 0 {
+			next = queues[order[0]][0]
+			output = scheduled
+		}
+		select {
+		case batch := <-input:
+			if len(batch.Msgs) == 0 {
+				break
+			}
+			container := batch.Msgs[0].Container
+			if u.containerLimit > 0 && byContainer[container] >= u.containerLimit {
+				u.adapter.stats.Add(`container_overflow_dropped`, int64(len(batch.Msgs)))
+				u.log("Dropping batch from %s, which has %d batches queued",
+					batch.sources(), byContainer[container])
+				break
+			}
+			byContainer[container]++
+			stream := batch.Msgs[0].logStream()
+			if len(queues[stream]) == 0 {
+				order = append(order, stream)
+			}
+			queues[stream] = append(queues[stream], batch)
+			queued++
+		case output <- next:
+			container := next.Msgs[0].Container
+			byContainer[container]--
+			if byContainer[container] == 0 {
+				delete(byContainer, container)
+			}
+			stream := order[0]
+			order = order[1:]
+			queues[stream] = queues[stream][1:]
+			if len(queues[stream]) > 0 { // back of the line
+				order = append(order, stream)
+			} else {
+				delete(queues, stream)
+			}
+			queued--
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package cloudwatch
+
+import "testing"
+
+// returns an uploader whose scheduler queues up to limit batches, and the
+// channel it sends them on. Nothing is received from that channel until the
+// test does, so every batch sent before then is queued.
+func newScheduler(limit int) (*CloudwatchUploader, chan CloudwatchBatch) {
+	u := &CloudwatchUploader{Input: make(chan CloudwatchBatch), queueLimit: limit,
+		adapter: &CloudwatchAdapter{stats: NewCounters()}}
+	scheduled := make(chan CloudwatchBatch)
+	go u.schedule(scheduled)
+	return u, scheduled
+}
+
+// returns a batch of one message for a stream, from a container
+func streamBatch(stream, container string) CloudwatchBatch {
+	batch := NewCloudwatchBatch()
+	batch.Append(CloudwatchMessage{Message: stream, Group: `g`, Stream: stream,
+		Container: container})
+	return *batch
+}
+
+func TestSchedulerTakesStreamsInTurn(t *testing.T) {
+	u, scheduled := newScheduler(DEFAULT_QUEUED_BATCHES)
+	for i := 0; i < 5; i++ {
+		u.Input <- streamBatch(`firehose`, `busy`)
+	}
+	u.Input <- streamBatch(`trickle-a`, `quiet-a`)
+	u.Input <- streamBatch(`trickle-b`, `quiet-b`)
+	got := []string{}
+	for i := 0; i < 7; i++ {
+		got = append(got, (<-scheduled).Msgs[0].Stream)
+	}
+	want := []string{`firehose`, `trickle-a`, `trickle-b`,
+		`firehose`, `firehose`, `firehose`, `firehose`}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("uploaded %v, want %v", got, want)
+		}
+	}
+}
+
+func TestContainerLimitDropsARunawayContainer(t *testing.T) {
+	u, scheduled := newScheduler(DEFAULT_QUEUED_BATCHES)
+	u.containerLimit = 2
+	for i := 0; i < 4; i++ {
+		u.Input <- streamBatch(`firehose`, `runaway`)
+	}
+	u.Input <- streamBatch(`trickle`, `quiet`)
+	if dropped := u.adapter.stats.Snapshot()[`container_overflow_dropped`]; dropped != 2 {
+		t.Errorf("dropped %d messages, want 2", dropped)
+	}
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		got = append(got, (<-scheduled).Msgs[0].Container)
+	}
+	want := []string{`runaway`, `quiet`, `runaway`}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("uploaded %v, want %v", got, want)
+		}
+	}
+	// once its batches are taken, the container may queue more
+	u.Input <- streamBatch(`firehose`, `runaway`)
+	if batch := <-scheduled; batch.Msgs[0].Container != `runaway` {
+		t.Errorf("uploaded %s, want the runaway container", batch.Msgs[0].Container)
+	}
+}
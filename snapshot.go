@@ -0,0 +1,132 @@
+package cloudwatch
+
+import (
+	"net/http"
+	"sort"
+)
+
+// AdapterSnapshot is a one-off record of a CloudwatchAdapter's state, for
+// diagnosing problems: its configuration (with secrets redacted, as at
+// /cloudwatch/config), its counters, which include upload errors by code,
+// and the state of each log stream it has seen.
+type AdapterSnapshot struct {
+	Config   AdapterConfig    `json:"config"`
+	Counters map[string]int64 `json:"counters"`
+	Paused   []string         `json:"paused_groups"`
+	Streams  []StreamSnapshot `json:"streams"`
+}
+
+// StreamSnapshot is the state of one log stream in an AdapterSnapshot.
+// Sequence tokens are not shown, only whether one is cached.
+type StreamSnapshot struct {
+	Group         string `json:"group"`
+	Stream        string `json:"stream"`
+	Role          string `json:"role,omitempty"`
+	HasToken      bool   `json:"has_token"`
+	LastUpload    string `json:"last_upload,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	Denied        bool   `json:"denied"`
+	HeldBatches   int    `json:"held_batches"`   // while its group is paused
+	BatchedEvents int    `json:"batched_events"` // waiting to be submitted
+	PacedEvents   int    `json:"paced_events"`   // held back by pacing
+}
+
+// a request for the state of the streams, which each goroutine that owns
+// some of that state adds to in turn
+type snapshotRequest struct {
+	Streams map[streamID]*StreamSnapshot
+	Paused  []string
+	done    chan bool
+}
+
+// returns the snapshot of the stream, adding it if it is new
+func (request *snapshotRequest) stream(id streamID) *StreamSnapshot {
+	if snapshot, exists := request.Streams[id]; exists {
+		return snapshot
+	}
+	snapshot := &StreamSnapshot{Group: id.Group, Stream: id.Stream, Role: id.Role}
+	request.Streams[id] = snapshot
+	return snapshot
+}
+
+// adds the uploader's state to a snapshot, in the uploader's goroutine
+func (u *CloudwatchUploader) fillSnapshot(request *snapshotRequest) {
+	for id, token := range u.tokens {
+		request.stream(id).HasToken = token != nil
+	}
+	for id, uploaded := range u.uploaded {
+		request.stream(id).LastUpload = timeString(uploaded)
+	}
+	for id, repeated := range u.errors {
+		request.stream(id).LastError = repeated.Text
+	}
+	for id := range u.denied {
+		request.stream(id).Denied = true
+	}
+	for _, batches := range u.held {
+		for _, batch := range batches {
+			request.stream(batch.Msgs[0].logStream()).HeldBatches++
+		}
+	}
+	for _, batch := range u.resumed {
+		request.stream(batch.Msgs[0].logStream()).HeldBatches++
+	}
+	request.Paused = []string{}
+	for group := range u.paused {
+		request.Paused = append(request.Paused, group)
+	}
+	sort.Strings(request.Paused)
+	request.done <- true
+}
+
+// adds the batcher's state to a snapshot, in the batcher's goroutine
+func (b *CloudwatchBatcher) fillSnapshot(request *snapshotRequest) {
+	for id, batch := range b.batches {
+		request.stream(id).BatchedEvents = len(batch.Msgs)
+	}
+	for id, queue := range b.paced {
+		request.stream(id).PacedEvents = len(queue)
+	}
+	request.done <- true
+}
+
+// returns a snapshot of the adapter's state, from any goroutine
+func (a *CloudwatchAdapter) Snapshot() AdapterSnapshot {
+	request := &snapshotRequest{
+		Streams: map[streamID]*StreamSnapshot{},
+		done:    make(chan bool),
+	}
+	a.batcher.uploader.snapshots <- request
+	<-request.done
+	a.batcher.snapshots <- request
+	<-request.done
+	streams := []StreamSnapshot{}
+	for _, snapshot := range request.Streams {
+		streams = append(streams, *snapshot)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Group != streams[j].Group {
+			return streams[i].Group < streams[j].Group
+		}
+		return streams[i].Stream < streams[j].Stream
+	})
+	return AdapterSnapshot{
+		Config:   a.Config(),
+		Counters: a.stats.Snapshot(),
+		Paused:   request.Paused,
+		Streams:  streams,
+	}
+}
+
+// serves a snapshot of each adapter with the admin endpoints enabled
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	list := adminAdapters(w)
+	if list == nil {
+		return
+	}
+	snapshots := []AdapterSnapshot{}
+	for _, adapter := range list {
+		snapshots = append(snapshots, adapter.Snapshot())
+	}
+	writeJSON(w, snapshots)
+}
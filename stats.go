@@ -0,0 +1,32 @@
+package cloudwatch
+
+import "sync"
+
+// Counters holds named counts of notable events, such as dropped messages,
+// which are reported by the debug endpoint. It is safe for concurrent use.
+type Counters struct {
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+func NewCounters() *Counters {
+	return &Counters{values: map[string]int64{}}
+}
+
+// adds delta to the named count
+func (c *Counters) Add(name string, delta int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[name] += delta
+}
+
+// returns a copy of the current counts
+func (c *Counters) Snapshot() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	snapshot := map[string]int64{}
+	for name, value := range c.values {
+		snapshot[name] = value
+	}
+	return snapshot
+}
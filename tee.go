@@ -0,0 +1,41 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// LOGSPOUT_CLOUDWATCH_TEE destinations
+const TEE_STDOUT = "stdout" // logspout's standard output
+const TEE_SYSLOG = "syslog" // the local syslog daemon
+
+// returns the writer that messages are copied to, as well as being sent to
+// Cloudwatch, or nil if they are not copied
+func newTee(route *router.Route) (io.Writer, error) {
+	switch destination := routeOption(route, `LOGSPOUT_CLOUDWATCH_TEE`, ""); destination {
+	case "":
+		return nil, nil
+	case TEE_STDOUT:
+		return os.Stdout, nil
+	case TEE_SYSLOG:
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, `logspout-cloudwatch`)
+	default:
+		return nil, fmt.Errorf("unknown tee destination %s", destination)
+	}
+}
+
+// copies a message to the tee, if set, as a line naming its log group and
+// stream, so local logs can be compared with Cloudwatch
+func (a *CloudwatchAdapter) copyToTee(msg CloudwatchMessage) {
+	if a.tee == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(a.tee, "%s %s %s\n", msg.Group, msg.Stream,
+		msg.Message); err != nil {
+		a.stats.Add(`tee_errors`, 1)
+	}
+}
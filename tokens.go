@@ -0,0 +1,154 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// a sequence token as saved in LOGSPOUT_CLOUDWATCH_TOKEN_FILE. Streams are
+// told apart by where they are, as well as by name, as in destinationKey.
+type savedToken struct {
+	Endpoint string  `json:"endpoint,omitempty"`
+	Region   string  `json:"region"`
+	Group    string  `json:"group"`
+	Stream   string  `json:"stream"`
+	Role     string  `json:"role,omitempty"`
+	Token    *string `json:"token"`
+}
+
+// returns the key of the stream that a saved token is for
+func (saved savedToken) key() destinationKey {
+	return destinationKey{Kind: DESTINATION_STREAM, Endpoint: saved.Endpoint,
+		Region: saved.Region, Role: saved.Role, Group: saved.Group,
+		Stream: saved.Stream}
+}
+
+// several routes may save their tokens to the same file, so each save reads
+// the file, and replaces only the tokens of its own route, in turn
+var tokenFiles sync.Mutex
+
+// tokens that changed are saved this often, rather than after every upload
+const TOKEN_SAVE_INTERVAL = 10 * time.Second
+
+// loads the sequence tokens saved by a previous run, if a token file is
+// configured, so streams resume without being described again. Only tokens
+// for streams at the uploader's endpoint and region are loaded. A stale token
+// costs a request: an upload rejected for using it fetches the token again,
+// and is retried once.
+func (u *CloudwatchUploader) loadTokens() {
+	if u.tokenFile == "" {
+		return
+	}
+	tokenFiles.Lock()
+	saved, err := readTokens(u.tokenFile)
+	tokenFiles.Unlock()
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not read token file:", err)
+		return
+	}
+	loaded := 0
+	for _, token := range saved {
+		if token.Endpoint != u.endpoint || token.Region != u.region {
+			continue
+		}
+		id := streamID{Group: token.Group, Stream: token.Stream, Role: token.Role}
+		u.tokens[id] = token.Token
+		loaded++
+	}
+	u.log("Loaded %d sequence tokens from %s", loaded, u.tokenFile)
+}
+
+// records that a stream's token was set or forgotten, to be saved
+func (u *CloudwatchUploader) tokenChanged(id streamID) {
+	if u.tokenFile != "" {
+		u.changedTokens[id] = true
+	}
+}
+
+// saves the sequence tokens that changed since the last save, if a token file
+// is configured, alongside the tokens that other routes saved to it. The file
+// is replaced atomically, so a crash never leaves it half-written.
+func (u *CloudwatchUploader) saveTokens() {
+	if u.tokenFile == "" || len(u.changedTokens) == 0 {
+		return
+	}
+	tokenFiles.Lock()
+	defer tokenFiles.Unlock()
+	saved, err := readTokens(u.tokenFile)
+	if err != nil { // rather than lose other routes' tokens
+		log.Println("cloudwatch: WARNING could not save tokens:", err)
+		return
+	}
+	tokens := map[destinationKey]savedToken{}
+	for _, token := range saved {
+		tokens[token.key()] = token
+	}
+	for id := range u.changedTokens {
+		token := savedToken{Endpoint: u.endpoint, Region: u.region,
+			Group: id.Group, Stream: id.Stream, Role: id.Role, Token: u.tokens[id]}
+		if _, isCached := u.tokens[id]; isCached {
+			tokens[token.key()] = token
+		} else {
+			delete(tokens, token.key())
+		}
+	}
+	u.changedTokens = map[streamID]bool{}
+	saved = []savedToken{}
+	for _, token := range tokens {
+		saved = append(saved, token)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not encode tokens:", err)
+		return
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(u.tokenFile), ".tokens")
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not save tokens:", err)
+		return
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), u.tokenFile)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		log.Println("cloudwatch: WARNING could not save tokens:", err)
+	}
+}
+
+// returns the sequence token that an upload rejected as already accepted
+// says the stream expects next, if the SDK reports it
+func expectedToken(err error) *string {
+	if accepted, ok := err.(*cloudwatchlogs.DataAlreadyAcceptedException); ok {
+		return accepted.ExpectedSequenceToken
+	}
+	return nil
+}
+
+// returns the tokens saved in a token file - none, if it doesn't exist yet
+func readTokens(path string) ([]savedToken, error) {
+	saved := []savedToken{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Println("cloudwatch: WARNING ignoring invalid token file:", err)
+		return []savedToken{}, nil
+	}
+	return saved, nil
+}
@@ -0,0 +1,77 @@
+package cloudwatch
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// returns an uploader that saves its tokens to the given file
+func tokenUploader(file, region string) *CloudwatchUploader {
+	return &CloudwatchUploader{tokenFile: file, region: region,
+		tokens: map[streamID]*string{}, changedTokens: map[streamID]bool{}}
+}
+
+func TestTokensSaveAndLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `tokens.json`)
+	id := streamID{Group: `g`, Stream: `s`, Role: `role`}
+	east, west := tokenUploader(file, `us-east-1`), tokenUploader(file, `us-west-2`)
+	for _, u := range []*CloudwatchUploader{east, west} {
+		u.tokens[id] = aws.String(u.region)
+		u.tokenChanged(id)
+		u.saveTokens()
+	}
+	unused := streamID{Group: `g`, Stream: `unused`}
+	east.tokens[unused] = nil
+	east.tokenChanged(unused)
+	east.saveTokens()
+	delete(east.tokens, unused)
+	east.tokenChanged(unused)
+	east.saveTokens()
+
+	for _, region := range []string{`us-east-1`, `us-west-2`} {
+		restarted := tokenUploader(file, region)
+		restarted.loadTokens()
+		if len(restarted.tokens) != 1 || aws.StringValue(restarted.tokens[id]) != region {
+			t.Errorf("loaded %v in %s, want only its own token", restarted.tokens, region)
+		}
+	}
+}
+
+func TestStaleSavedTokenIsRecovered(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	f.groups[`g`] = true
+	f.streams[`g/s`] = &fakeStream{token: 3} // uploaded to since it was saved
+	file := filepath.Join(t.TempDir(), `tokens.json`)
+	saved := tokenUploader(file, `us-east-1`)
+	saved.endpoint = f.server.URL
+	saved.tokens[streamID{Group: `g`, Stream: `s`}] = fakeToken(1)
+	saved.tokenChanged(streamID{Group: `g`, Stream: `s`})
+	saved.saveTokens()
+
+	a := f.adapter(t, map[string]string{`DELAY`: `1`,
+		`LOGSPOUT_CLOUDWATCH_TOKEN_FILE`: file})
+	a.batcher.Input <- CloudwatchMessage{Message: `hello`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	f.await(t, "the upload", func() bool { return len(f.messages(`g`, `s`)) == 1 })
+	if count := f.count(`PutLogEvents`); count != 2 {
+		t.Errorf("%d uploads were made, want the rejected one and one retry", count)
+	}
+}
+
+func TestAlreadyAcceptedBatchIsNotResent(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	f.failures[`PutLogEvents`] = []string{cloudwatchlogs.ErrCodeDataAlreadyAcceptedException}
+	a := f.adapter(t, map[string]string{`DELAY`: `1`})
+	a.batcher.Input <- CloudwatchMessage{Message: `hello`, Group: `g`, Stream: `s`,
+		Time: time.Now()}
+	f.await(t, "the batch to be counted", func() bool {
+		return a.stats.Snapshot()[`already_accepted_batches`] == 1
+	})
+	if count := f.count(`PutLogEvents`); count != 1 {
+		t.Errorf("%d uploads were made, want the batch sent once", count)
+	}
+}
@@ -0,0 +1,91 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// matches ANSI escape sequences, such as terminal colours
+const ANSI_PATTERN = `\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[@-Z\\-_]`
+
+// matches common secrets in key=value or "key": "value" form, for the
+// redact transform
+const DEFAULT_REDACT_PATTERN = `(?i)(?:password|passwd|secret|token|api[_-]?key)["']?\s*[:=]\s*["']?[^\s"',;]+`
+
+// a transform applied to the text of each message
+type transform func(string) string
+
+// the transforms that LOGSPOUT_CLOUDWATCH_TRANSFORMS can apply, by name.
+// Each is made for a route, as some take their settings from its options.
+var transforms = map[string]func(*router.Route) (transform, error){
+	`trim`: func(route *router.Route) (transform, error) {
+		return strings.TrimSpace, nil
+	},
+	`strip-ansi`: func(route *router.Route) (transform, error) {
+		ansi := regexp.MustCompile(ANSI_PATTERN)
+		return func(text string) string {
+			return ansi.ReplaceAllString(text, "")
+		}, nil
+	},
+	`redact`: func(route *router.Route) (transform, error) {
+		pattern, err := regexp.Compile(routeOption(route,
+			`LOGSPOUT_CLOUDWATCH_REDACT_PATTERN`, DEFAULT_REDACT_PATTERN))
+		if err != nil {
+			return nil, err
+		}
+		return func(text string) string {
+			return pattern.ReplaceAllString(text, REDACTED)
+		}, nil
+	},
+}
+
+// returns the names of the transforms in a comma-separated list, in order
+func parseTransforms(text string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(text, `,`) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, exists := transforms[name]; !exists {
+			return nil, fmt.Errorf("unknown transform %s", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// returns the route's transforms, made in the configured order
+func newTransforms(route *router.Route) ([]transform, error) {
+	names, err := parseTransforms(routeOption(route,
+		`LOGSPOUT_CLOUDWATCH_TRANSFORMS`, ""))
+	if err != nil {
+		return nil, err
+	}
+	pipeline := []transform{}
+	for _, name := range names {
+		apply, err := transforms[name](route)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, apply)
+	}
+	return pipeline, nil
+}
+
+// returns a copy of the message with the transforms applied to its text, in
+// order - or the message itself, if there are none. The message is copied as
+// logspout shares it between routes.
+func (a *CloudwatchAdapter) transform(message *router.Message) *router.Message {
+	if len(a.transforms) == 0 {
+		return message
+	}
+	transformed := *message
+	for _, apply := range a.transforms {
+		transformed.Data = apply(transformed.Data)
+	}
+	return &transformed
+}
@@ -1,36 +1,189 @@
 package cloudwatch
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/gliderlabs/logspout/router"
 )
 
 // CloudwatchUploader receieves CloudwatchBatches on its input channel,
 // and sends them on to the AWS Cloudwatch Logs endpoint.
 type CloudwatchUploader struct {
-	Input         chan CloudwatchBatch
-	adapter       *CloudwatchAdapter
-	svc           *cloudwatchlogs.CloudWatchLogs
-	tokens        map[string]string
-	debugSet      bool
-}
-
-func NewCloudwatchUploader(adapter *CloudwatchAdapter) *CloudwatchUploader {
-	region := adapter.Route.Address
-	if (region == "auto") || (region == "") {
-		if adapter.Ec2Region == "" {
-			log.Println("cloudwatch: ERROR - could not get region from EC2")
-		} else {
-			region = adapter.Ec2Region
-		}
+	Input    chan CloudwatchBatch
+	adapter  *CloudwatchAdapter
+	svc      *cloudwatchlogs.CloudWatchLogs
+	region   string
+	session  *session.Session
+	config   *aws.Config
+	endpoint string                                    // the Cloudwatch Logs endpoint URL, if not the default
+	roles    map[string]*cloudwatchlogs.CloudWatchLogs // clients by role ARN
+	// assumed roles' credentials last this long, and are renewed this early
+	roleDuration time.Duration
+	roleRenewal  time.Duration
+	// how long to wait for a new stream to be listed by DescribeLogStreams
+	createWait time.Duration
+	// and for a new group to be listed by DescribeLogGroups
+	groupCreateWait time.Duration
+	// how often each page of DescribeLogStreams is retried
+	describeRetries int
+	// written as the first event of each stream the uploader creates, if set
+	header *template.Template
+	// writes a marker event ahead of each batch
+	markers bool
+	// a nil token means the stream has no token yet, so none is sent
+	tokens    map[streamID]*string
+	tokenFile string // where tokens are saved across restarts, if set
+	debugSet  bool
+	errors    map[streamID]*repeatedError // last error for each stream
+	// the streams whose tokens changed since they were last saved
+	changedTokens map[streamID]bool
+	// streams that were denied access, and when they were last tried
+	denied         map[streamID]time.Time
+	deniedPolicy   string
+	deniedInterval time.Duration
+	// whether a group or stream that already exists fails its creation
+	existsPolicy string
+	// in metrics-only mode, errors are counted by code, and summarized
+	metricsOnly bool
+	rollup      map[string]int64
+	queueLimit  int // how many batches may wait to be uploaded
+	// and how many of them may come from one container, if limited
+	containerLimit int
+	// PutLogEvents requests are spaced at least this far apart, if set
+	putInterval time.Duration
+	lastPut     time.Time
+	// samples of rejected messages are logged, if enabled, at a limited rate
+	samples       bool
+	sampleRedact  *regexp.Regexp // matches text to hide in samples, if set
+	sampleCount   int
+	sampleStarted time.Time
+	// empty batches are counted, and warned of if there are too many
+	emptyWarning int
+	emptyCount   int
+	emptyStarted time.Time
+	// streams with too many token conflicts are split, if enabled, into
+	// streams named after this host
+	splitAfter   int
+	conflicts    map[streamID]*conflictCount
+	splits       map[streamID]string // the stream each split stream moved to
+	splitStreams map[streamID]bool   // the streams moved to
+	// uploads to paused groups are held or dropped, until they are resumed
+	pauses      chan pauseRequest
+	paused      map[string]bool
+	held        map[string][]CloudwatchBatch
+	resumed     []CloudwatchBatch // held batches of resumed groups, to upload
+	pausePolicy string
+	// requests for the state of the streams, and when each last uploaded
+	snapshots chan *snapshotRequest
+	uploaded  map[streamID]time.Time
+	// dropped batches are reported to the diagnostics group, if set
+	diagnosticsGroup  string
+	diagnosticsStream string
+	diagnostics       *CloudwatchBatch // events not yet uploaded
+	// events delivered to each stream are checkpointed, if enabled
+	checkpointInterval time.Duration
+	counts             map[streamID]*streamCount
+	latency            bool // counts delivery latency in a histogram
+}
+
+// tracks an error that keeps recurring for a stream, so that it is only
+// logged once, followed by periodic summaries of how often it recurred.
+type repeatedError struct {
+	Text       string    // the error message
+	Suppressed int       // repeats not yet logged
+	Summarized time.Time // when the error was last logged or summarized
+}
+
+// identifies this adapter in the User-Agent of its AWS requests
+const USER_AGENT = "logspout-cloudwatch"
+
+// the adapter's version, which can be set when building, with
+// -ldflags "-X github.com/mdsol/logspout-cloudwatch.Version=1.2.3"
+var Version = "dev"
+
+// LOGSPOUT_CLOUDWATCH_ON_ACCESS_DENIED policies
+const ACCESS_DENIED_RETRY = "retry" // keep uploading every batch
+const ACCESS_DENIED_DROP = "drop"   // drop batches, but try again periodically
+const ACCESS_DENIED_CODE = "AccessDeniedException"
+
+// counts errors that didn't come from AWS, such as network failures
+const OTHER_ERROR_CODE = "Other"
+
+// with the drop policy, how often uploads to a denied stream are tried
+const DEFAULT_ACCESS_DENIED_INTERVAL = 5 * time.Minute
+
+// how much of a rejected message is logged, and how many are logged every
+// ERROR_SUMMARY_INTERVAL, with LOGSPOUT_CLOUDWATCH_LOG_REJECTED
+const REJECTED_SAMPLE_LENGTH = 200 // bytes
+const REJECTED_SAMPLES = 10
+
+// HTTP transport settings for AWS requests, where they differ from Go's
+const DEFAULT_MAX_IDLE_CONNS_PER_HOST = 10
+const DEFAULT_KEEP_ALIVE = 30 * time.Second // between TCP keep-alive probes
+const DIAL_TIMEOUT = 30 * time.Second
+
+// how often repeats of an identical error are summarized
+const ERROR_SUMMARY_INTERVAL = time.Minute
+
+// more empty batches than this in an ERROR_SUMMARY_INTERVAL are warned of
+const DEFAULT_EMPTY_BATCH_WARNING = 10
+
+// Cloudwatch Logs is eventually consistent, so a newly created log stream may
+// not be listed straight away. It is polled for up to DEFAULT_CREATE_WAIT.
+const DEFAULT_CREATE_WAIT = 2 * time.Second
+const CREATE_POLL_INTERVAL = 250 * time.Millisecond
+
+// likewise, a newly created log group is polled for up to this long before
+// its retention policy is set and streams are created in it
+const DEFAULT_GROUP_CREATE_WAIT = 2 * time.Second
+
+const ACCOUNT_ID_TIMEOUT = 5 * time.Second    // for the STS request at startup
+const INSTANCE_TAGS_TIMEOUT = 5 * time.Second // for the EC2 request at startup
+
+// assumed roles' credentials are renewed this long before they expire
+const DEFAULT_ROLE_RENEWAL = time.Minute
+
+// each page of DescribeLogStreams is retried after transient errors, waiting
+// twice as long before each retry - or as long as a throttling response's
+// Retry-After header asks, up to MAX_RETRY_AFTER
+const DEFAULT_DESCRIBE_RETRIES = 3
+const DESCRIBE_RETRY_DELAY = 200 * time.Millisecond
+const MAX_RETRY_AFTER = time.Minute
+
+func NewCloudwatchUploader(adapter *CloudwatchAdapter) (*CloudwatchUploader, error) {
+	region := uploadRegion(adapter.Route, adapter.Ec2Region)
+	if region == "" {
+		log.Println("cloudwatch: ERROR - could not get region from EC2")
+	}
+	// the region option overrides the address, which then names nothing
+	if address := adapter.Route.Address; address != "auto" && address != "" &&
+		address != region {
+		log.Printf("cloudwatch: WARNING ignoring route address %s, as "+
+			"LOGSPOUT_CLOUDWATCH_REGION is set; to name an endpoint, set "+
+			"LOGSPOUT_CLOUDWATCH_ENDPOINT\n", address)
 	}
+	endpoint := routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_ENDPOINT`, "")
 	debugSet := false
 	_, debugOption := adapter.Route.Options[`DEBUG`]
 	if debugOption || (os.Getenv(`DEBUG`) != "") {
@@ -38,182 +191,697 @@ func NewCloudwatchUploader(adapter *CloudwatchAdapter) *CloudwatchUploader {
 		log.Println("cloudwatch: Creating AWS Cloudwatch client for region",
 			region)
 	}
+	awsConfig := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		awsConfig.EndpointResolver = logsEndpointResolver(endpoint)
+	}
+	if awsDebug := routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_AWS_DEBUG`, ""); awsDebug != "" {
+		logLevel, err := parseAWSLogLevel(awsDebug)
+		if err != nil {
+			log.Println("cloudwatch: WARNING ignoring LOGSPOUT_CLOUDWATCH_AWS_DEBUG:", err)
+		} else {
+			awsConfig.LogLevel = aws.LogLevel(logLevel)
+			awsConfig.Logger = aws.LoggerFunc(func(args ...interface{}) {
+				log.Println(append([]interface{}{"cloudwatch: aws:"}, args...)...)
+			})
+		}
+	}
+	if maxRetries := routeIntOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_AWS_MAX_RETRIES`, -1); maxRetries >= 0 {
+		awsConfig.MaxRetries = aws.Int(maxRetries)
+	}
+	awsConfig.HTTPClient = &http.Client{Transport: newTransport(adapter.Route)}
+	// the session has the resolved region, too, for the clients made from it
+	// without awsConfig, such as the STS client that assumes roles
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cloudwatch: could not create AWS session: %s", err)
+	}
+	userAgent := USER_AGENT + "/" + Version
+	if custom := routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_USER_AGENT`, ""); custom != "" {
+		userAgent += " " + custom
+	}
+	awsSession.Handlers.Build.PushBack(
+		request.MakeAddToUserAgentFreeFormHandler(userAgent))
 	uploader := CloudwatchUploader{
-		Input: make(chan CloudwatchBatch),
-		tokens: map[string]string{},
-		debugSet: debugSet,
-		adapter: adapter,
-		svc: cloudwatchlogs.New(session.New(),
-			&aws.Config{Region: aws.String(region)}),
+		Input:  make(chan CloudwatchBatch),
+		tokens: map[streamID]*string{},
+		errors: map[streamID]*repeatedError{},
+		denied: map[streamID]time.Time{},
+		deniedPolicy: routeOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ON_ACCESS_DENIED`, ACCESS_DENIED_DROP),
+		deniedInterval: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ACCESS_DENIED_INTERVAL`, DEFAULT_ACCESS_DENIED_INTERVAL),
+		existsPolicy: routeOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ALREADY_EXISTS`, ALREADY_EXISTS_IGNORE),
+		metricsOnly: routeFlag(adapter.Route, `LOGSPOUT_CLOUDWATCH_ERROR_METRICS_ONLY`),
+		rollup:      map[string]int64{},
+		debugSet:    debugSet,
+		adapter:     adapter,
+		region:      region,
+		session:     awsSession,
+		config:      awsConfig,
+		endpoint:    endpoint,
+		roles:       map[string]*cloudwatchlogs.CloudWatchLogs{},
+		createWait: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_CREATE_WAIT`, DEFAULT_CREATE_WAIT),
+		groupCreateWait: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_GROUP_CREATE_WAIT`, DEFAULT_GROUP_CREATE_WAIT),
+		roleDuration: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ROLE_DURATION`, stscreds.DefaultDuration),
+		roleRenewal: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ROLE_RENEWAL`, DEFAULT_ROLE_RENEWAL),
+		markers: routeFlag(adapter.Route, `LOGSPOUT_CLOUDWATCH_BATCH_MARKERS`),
+		describeRetries: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_DESCRIBE_RETRIES`, DEFAULT_DESCRIBE_RETRIES),
+		tokenFile:     routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_TOKEN_FILE`, ""),
+		changedTokens: map[streamID]bool{},
+		queueLimit: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_QUEUED_BATCHES`, DEFAULT_QUEUED_BATCHES),
+		emptyWarning: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_EMPTY_BATCH_WARNING`, DEFAULT_EMPTY_BATCH_WARNING),
+		putInterval: tpsInterval(routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_PUTLOGEVENTS_TPS`, 0)),
+		containerLimit: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_CONTAINER_QUEUED_BATCHES`, 0),
+		splitAfter: routeIntOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_SPLIT_ON_CONFLICTS`, 0),
+		conflicts:    map[streamID]*conflictCount{},
+		splits:       map[streamID]string{},
+		splitStreams: map[streamID]bool{},
+		pauses:       make(chan pauseRequest),
+		snapshots:    make(chan *snapshotRequest),
+		uploaded:     map[streamID]time.Time{},
+		paused:       map[string]bool{},
+		held:         map[string][]CloudwatchBatch{},
+		pausePolicy: routeOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_ON_PAUSE`, PAUSE_HOLD),
+		diagnosticsGroup: routeOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_GROUP`, ""),
+		diagnosticsStream: routeOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_DIAGNOSTICS_STREAM`, adapter.OsHost),
+		checkpointInterval: routeDurationOption(adapter.Route,
+			`LOGSPOUT_CLOUDWATCH_CHECKPOINT_INTERVAL`, 0),
+		counts:  map[streamID]*streamCount{},
+		latency: routeFlag(adapter.Route, `LOGSPOUT_CLOUDWATCH_DELIVERY_LATENCY`),
+		svc:     cloudwatchlogs.New(awsSession, awsConfig),
+	}
+	if _, samples := adapter.Route.Options[`LOGSPOUT_CLOUDWATCH_LOG_REJECTED`]; samples ||
+		os.Getenv(`LOGSPOUT_CLOUDWATCH_LOG_REJECTED`) != "" {
+		uploader.samples = true
+		if pattern := routeOption(adapter.Route, `LOGSPOUT_CLOUDWATCH_REJECTED_REDACT`, ""); pattern != "" {
+			if uploader.sampleRedact, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+	uploader.header, err = parseHeader(routeOption(adapter.Route,
+		`LOGSPOUT_CLOUDWATCH_STREAM_HEADER`, ""))
+	if err != nil {
+		return nil, err
 	}
+	uploader.loadTokens()
 	go uploader.Start()
-	return &uploader
+	return &uploader, nil
 }
 
 // Main loop for the Uploader - POSTs each batch to AWS Cloudwatch Logs,
 // while keeping track of the unique sequence token for each log stream.
+// Batches are taken from each log stream in turn, by the scheduler.
+// A SIGHUP clears the cached tokens, so each stream's token is fetched again.
 func (u *CloudwatchUploader) Start() {
-	for batch := range u.Input {
-		msgLen := len(batch.Msgs)
-		if msgLen == 0 {
-			u.log("The batch input does not have any messages")
-			continue
-		}
-		msg := batch.Msgs[0]
-		u.log("Submitting batch for %s-%s (length %d, size %v)",
-			msg.Group, msg.Stream, len(batch.Msgs), batch.Size)
-
-		// fetch and cache the upload sequence token
-		var token *string
-		if cachedToken, isCached := u.tokens[msg.Container]; isCached {
-			token = &cachedToken
-			u.log("Got token from cache: %s", *token)
-		} else {
-			u.log("Fetching token from AWS...")
-			awsToken, err := u.getSequenceToken(msg)
-			if err != nil {
-				u.log("ERROR:", err)
-				continue
-			}
-			if awsToken != nil {
-				u.tokens[msg.Container] = *(awsToken)
-				u.log("Got token from AWS:", *awsToken)
-				token = awsToken
+	scheduled := make(chan CloudwatchBatch)
+	go u.schedule(scheduled)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	var rollupTimer <-chan time.Time // only ticks in metrics-only mode
+	if u.metricsOnly {
+		ticker := time.NewTicker(ERROR_SUMMARY_INTERVAL)
+		defer ticker.Stop()
+		rollupTimer = ticker.C
+	}
+	var tokenTimer <-chan time.Time // only ticks with a token file
+	if u.tokenFile != "" {
+		ticker := time.NewTicker(TOKEN_SAVE_INTERVAL)
+		defer ticker.Stop()
+		tokenTimer = ticker.C
+	}
+	var bucketTimer <-chan time.Time // only ticks with stream buckets
+	if u.adapter.streamBucket.Format != "" {
+		ticker := time.NewTicker(BUCKET_EVICT_INTERVAL)
+		defer ticker.Stop()
+		bucketTimer = ticker.C
+	}
+	var checkpointTimer <-chan time.Time // only ticks with checkpoints
+	if u.checkpointInterval > 0 {
+		ticker := time.NewTicker(u.checkpointInterval)
+		defer ticker.Stop()
+		checkpointTimer = ticker.C
+	}
+	for {
+		select {
+		case batch := <-scheduled:
+			u.submit(batch)
+		case <-hangups:
+			log.Printf("cloudwatch: clearing %d cached sequence tokens\n",
+				len(u.tokens))
+			for id := range u.tokens {
+				u.tokenChanged(id)
 			}
+			u.tokens = map[streamID]*string{}
+			forgetDestinationTokens() // so other adapters don't pass them back
+			u.saveTokens()
+		case <-tokenTimer:
+			u.saveTokens()
+		case <-rollupTimer:
+			u.logRollup()
+		case <-checkpointTimer:
+			u.sendCheckpoints()
+		case now := <-bucketTimer:
+			u.evictBuckets(now)
+		case request := <-u.pauses:
+			u.setPaused(request)
+		case <-u.resuming():
+			u.upload(u.resumed[0])
+			u.resumed = u.resumed[1:]
+		case request := <-u.snapshots:
+			u.fillSnapshot(request)
+		}
+		u.flushDiagnostics()
+	}
+}
+
+// checks a batch against the PutLogEvents limits, then uploads the valid
+// batches that result
+func (u *CloudwatchUploader) submit(batch CloudwatchBatch) {
+	batches, problems := batch.validate(time.Now(), u.markers)
+	for _, problem := range problems {
+		log.Println("cloudwatch: WARNING invalid batch:",
+			problem.Text+u.sample(problem))
+	}
+	if len(batches) == 0 {
+		u.log("The batch input does not have any messages")
+		u.countEmpty()
+		return
+	}
+	for _, valid := range batches {
+		u.upload(valid)
+	}
+}
+
+// submits a single, valid batch to its log stream, using (and caching) the
+// stream's sequence token.
+func (u *CloudwatchUploader) upload(batch CloudwatchBatch) {
+	batch = u.splitBatch(batch)
+	msg := batch.Msgs[0]
+	if u.paused[msg.Group] {
+		u.holdBatch(batch)
+		return
+	}
+	if deniedAt, isDenied := u.denied[msg.logStream()]; isDenied &&
+		u.deniedPolicy == ACCESS_DENIED_DROP &&
+		time.Since(deniedAt) < u.deniedInterval {
+		u.log("Dropping batch for %s-%s, which was denied access", msg.Group, msg.Stream)
+		u.adapter.stats.Add(`access_denied_dropped`, int64(len(batch.Msgs)))
+		u.reportDrop(batch, ACCESS_DENIED_CODE)
+		return
+	}
+	u.log("Submitting batch for %s-%s (length %d, %s)",
+		msg.Group, msg.Stream, len(batch.Msgs), batch.describeSize())
+	svc := u.client(msg.Role)
+
+	// other adapters in this process may be uploading to the same stream,
+	// so take turns, and start from the token the last of them left. If the
+	// token must be fetched, the group is made sure of first, without
+	// holding the stream's lock.
+	lock := u.lockStream(msg.Role, msg.Group, msg.Stream)
+	if _, isCached := u.tokens[msg.logStream()]; !isCached && !lock.written {
+		lock.Unlock()
+		if err := u.ensureGroup(svc, msg.Role, msg.Group); err != nil {
+			u.logError(batch, err)
+			u.reportDrop(batch, errorCode(err))
+			return
 		}
+		lock = u.lockStream(msg.Role, msg.Group, msg.Stream)
+	}
+	defer lock.Unlock()
+	if lock.written {
+		u.tokens[msg.logStream()] = lock.token
+	}
 
-		// generate the array of InputLogEvent from the batch's contents
-		events := []*cloudwatchlogs.InputLogEvent{}
-		for _, msg := range batch.Msgs {
-			event := cloudwatchlogs.InputLogEvent{
-				Message:   aws.String(msg.Message),
-				Timestamp: aws.Int64(msg.Time.UnixNano() / 1000000),
-			}
-			events = append(events, &event)
+	// fetch and cache the upload sequence token
+	token, isCached := u.tokens[msg.logStream()]
+	if isCached {
+		u.log("Got token from cache: %s", aws.StringValue(token))
+	} else {
+		u.log("Fetching token from AWS...")
+		awsToken, err := u.getSequenceToken(svc, msg)
+		if err != nil {
+			u.logError(batch, err)
+			u.reportDrop(batch, errorCode(err))
+			return
 		}
-		params := &cloudwatchlogs.PutLogEventsInput{
-			LogEvents:     events,
-			LogGroupName:  aws.String(msg.Group),
-			LogStreamName: aws.String(msg.Stream),
-			SequenceToken: token,
+		u.tokens[msg.logStream()] = awsToken
+		u.log("Got token from AWS: %s", aws.StringValue(awsToken))
+		token = awsToken
+	}
+
+	// generate the array of InputLogEvent from the batch's contents
+	events := []*cloudwatchlogs.InputLogEvent{}
+	if u.markers {
+		events = append(events, batch.marker())
+	}
+	for _, msg := range batch.Msgs {
+		event := cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(msg.Message),
+			Timestamp: aws.Int64(msg.Time.UnixNano() / 1000000),
 		}
+		events = append(events, &event)
+	}
+	params := &cloudwatchlogs.PutLogEventsInput{
+		LogEvents:     events,
+		LogGroupName:  aws.String(msg.Group),
+		LogStreamName: aws.String(msg.Stream),
+		SequenceToken: token,
+	}
 
-		u.log("POSTing PutLogEvents to %s-%s with %d messages, %d bytes",
-			msg.Group, msg.Stream, len(batch.Msgs), batch.Size)
-		resp, err := u.svc.PutLogEvents(params)
-		if err != nil {
-			u.log(err.Error())
-			continue
+	u.log("POSTing PutLogEvents to %s-%s with %d messages, %s",
+		msg.Group, msg.Stream, len(batch.Msgs), batch.describeSize())
+	u.waitForQuota()
+	resp, err := svc.PutLogEvents(params)
+	if err != nil && conflictCodes[errorCode(err)] {
+		// the token was stale, such as one saved before a restart, or left
+		// by another writer, so fetch it again and retry once
+		u.countConflict(msg, err)
+		u.log("Stale token for %s-%s, fetching it again...", msg.Group, msg.Stream)
+		params.SequenceToken, err = u.getSequenceToken(svc, msg)
+		if err == nil {
+			u.waitForQuota()
+			resp, err = svc.PutLogEvents(params)
 		}
-		u.log("Got 200 response")
-		if resp.NextSequenceToken != nil {
-			u.log("Caching new sequence token for %s-%s: %s",
-				msg.Group, msg.Stream, *resp.NextSequenceToken)
-			u.tokens[msg.Container] = *resp.NextSequenceToken
+	}
+	if errorCode(err) == cloudwatchlogs.ErrCodeDataAlreadyAcceptedException {
+		// an earlier attempt was stored, though its response was lost, so
+		// the batch is delivered, and sending it again would duplicate it
+		u.log("Batch for %s-%s was already accepted", msg.Group, msg.Stream)
+		u.adapter.stats.Add(`already_accepted_batches`, 1)
+		resp, err = &cloudwatchlogs.PutLogEventsOutput{
+			NextSequenceToken: expectedToken(err)}, nil
+	}
+	if err != nil {
+		u.logError(batch, err)
+		u.reportDrop(batch, errorCode(err))
+		lock.setToken(nil, false)
+		if _, isCached := u.tokens[msg.logStream()]; isCached {
+			delete(u.tokens, msg.logStream()) // the token may be stale, so refetch it
+			u.tokenChanged(msg.logStream())
 		}
+		return
 	}
+	u.log("Got 200 response")
+	u.clearErrors(msg)
+	u.log("Caching new sequence token for %s-%s: %s",
+		msg.Group, msg.Stream, aws.StringValue(resp.NextSequenceToken))
+	u.tokens[msg.logStream()] = resp.NextSequenceToken
+	lock.setToken(resp.NextSequenceToken, true)
+	u.tokenChanged(msg.logStream())
+	u.uploaded[msg.logStream()] = time.Now()
+	u.countDelivered(batch)
+	u.recordLatency(batch)
 }
 
 // AWS CLIENT METHODS
 
+// returns the AWS account ID of the uploader's credentials, from STS, or an
+// empty string if STS can't be reached in time.
+func (u *CloudwatchUploader) accountID() string {
+	ctx, cancel := context.WithTimeout(context.Background(), ACCOUNT_ID_TIMEOUT)
+	defer cancel()
+	identity, err := sts.New(u.session, u.config).GetCallerIdentityWithContext(
+		ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Println("cloudwatch: WARNING could not get AWS account ID:", err)
+		return ""
+	}
+	return aws.StringValue(identity.Account)
+}
+
 // returns the next sequence token for the log stream associated
-// with the given message's group and stream. Creates the stream as needed.
-func (u *CloudwatchUploader) getSequenceToken(msg CloudwatchMessage) (*string,
-	error) {
+// with the given message's group and stream. Creates the stream as needed,
+// in a group that ensureGroup has made sure of.
+func (u *CloudwatchUploader) getSequenceToken(svc *cloudwatchlogs.CloudWatchLogs,
+	msg CloudwatchMessage) (*string, error) {
 	group, stream := msg.Group, msg.Stream
-	groupExists, err := u.groupExists(group)
-	if err != nil {
+	found, token, err := u.describeStream(svc, group, stream)
+	if err != nil || found {
+		return token, err
+	}
+	// no matching stream - create one, and give it time to be listed
+	err = u.createStream(svc, group, stream)
+	if err != nil && !u.ignoreExists(err) {
 		return nil, err
 	}
+	if err == nil && u.header != nil { // a stream accepting its header is ready for more
+		token, err := u.sendHeader(svc, msg)
+		if err == nil {
+			return token, nil
+		}
+		log.Printf("cloudwatch: WARNING could not write header to %s-%s: %s\n",
+			group, stream, err)
+	}
+	deadline := time.Now().Add(u.createWait)
+	for time.Now().Before(deadline) {
+		time.Sleep(CREATE_POLL_INTERVAL)
+		found, token, err = u.describeStream(svc, group, stream)
+		if err != nil || found {
+			return token, err
+		}
+	}
+	// a new stream has no sequence token yet, so try uploading anyway
+	u.log("Stream %s-%s not listed %s after creation", group, stream, u.createWait)
+	return nil, nil
+}
+
+// creates a log group, and its retention policy, unless it already exists.
+// Adapters in this process take turns, so only one of them creates it.
+func (u *CloudwatchUploader) ensureGroup(svc *cloudwatchlogs.CloudWatchLogs,
+	role, group string) error {
+	lock := u.lockGroup(role, group)
+	defer lock.Unlock()
+	groupExists, err := u.groupExists(svc, group)
+	if err != nil {
+		return err
+	}
 	if !groupExists {
-		err = u.createGroup(group)
+		err = u.createGroup(svc, group)
+		if u.ignoreExists(err) {
+			return nil // created elsewhere, along with its retention policy
+		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err = u.awaitGroup(svc, group); err != nil {
+			return err
 		}
 
-		if retentionDays, retentionDaysConfigured := u.adapter.retentiondays[group]; retentionDaysConfigured {
-			err = u.createGroupRetentionPolicy(group, retentionDays)
-			if err != nil {
-				return nil, err
-			}
+		if retentionDays, retentionDaysConfigured, _, _ := u.adapter.groupSettings(group); retentionDaysConfigured {
+			return u.createGroupRetentionPolicy(svc, group, retentionDays)
 		}
 	}
+	return nil
+}
+
+// returns whether the given log stream exists, and if so, its next sequence
+// token (which is nil for a stream that has never been written to). Streams
+// are listed by prefix, so every page of matches is searched for the exact
+// name, as a group may have thousands of streams sharing the prefix.
+func (u *CloudwatchUploader) describeStream(svc *cloudwatchlogs.CloudWatchLogs,
+	group, stream string) (bool, *string, error) {
 	params := &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(group),
 		LogStreamNamePrefix: aws.String(stream),
 	}
 	u.log("Describing stream %s-%s...", group, stream)
-	resp, err := u.svc.DescribeLogStreams(params)
-	if err != nil {
-		return nil, err
+	for {
+		resp, err := u.describeStreamsPage(svc, params)
+		if err != nil {
+			return false, nil, err
+		}
+		for _, matched := range resp.LogStreams {
+			if aws.StringValue(matched.LogStreamName) == stream {
+				return true, matched.UploadSequenceToken, nil
+			}
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			return false, nil, nil
+		}
+		params.NextToken = resp.NextToken
 	}
-	if count := len(resp.LogStreams); count > 1 { // too many matching streams!
-		return nil, errors.New(fmt.Sprintf(
-			"%d streams match group %s, stream %s!", count, group, stream))
+}
+
+// requests one page of DescribeLogStreams, retrying transient errors (such
+// as throttling) up to LOGSPOUT_CLOUDWATCH_DESCRIBE_RETRIES times, so an
+// error part way through the pages doesn't abort the whole search.
+func (u *CloudwatchUploader) describeStreamsPage(svc *cloudwatchlogs.CloudWatchLogs,
+	params *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	for attempt := 0; ; attempt++ {
+		req, resp := svc.DescribeLogStreamsRequest(params)
+		err := req.Send()
+		if err == nil || attempt >= u.describeRetries ||
+			!(request.IsErrorRetryable(err) || request.IsErrorThrottle(err)) {
+			return resp, err
+		}
+		delay, hinted := retryAfter(req.HTTPResponse, time.Now())
+		if !hinted {
+			delay = DESCRIBE_RETRY_DELAY << uint(attempt)
+		}
+		u.log("Retrying DescribeLogStreams for %s in %s: %s",
+			aws.StringValue(params.LogGroupName), delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// returns how long a response's Retry-After header asks to wait before the
+// next attempt, given as seconds or as an HTTP date, up to MAX_RETRY_AFTER -
+// and whether the response had a valid one.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	text := resp.Header.Get(`Retry-After`)
+	if text == "" {
+		return 0, false
 	}
-	if len(resp.LogStreams) == 0 { // no matching streams - create one and retry
-		if err = u.createStream(group, stream); err != nil {
-			return nil, err
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(text); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(text); err == nil {
+		delay = date.Sub(now)
+		if delay < 0 {
+			delay = 0
 		}
-		token, err := u.getSequenceToken(msg)
-		return token, err
+	} else {
+		return 0, false
 	}
-	return resp.LogStreams[0].UploadSequenceToken, nil
+	if delay > MAX_RETRY_AFTER {
+		delay = MAX_RETRY_AFTER
+	}
+	return delay, true
 }
 
-func (u *CloudwatchUploader) groupExists(group string) (bool, error) {
+// returns whether the given log group exists. Groups are listed by prefix,
+// which the group's full name is the most specific, but other groups can
+// still share it (such as app-prod for app), so every page of matches is
+// searched for the exact name.
+func (u *CloudwatchUploader) groupExists(svc *cloudwatchlogs.CloudWatchLogs,
+	group string) (bool, error) {
 	u.log("Checking for group: %s...", group)
-	resp, err := u.svc.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
+	params := &cloudwatchlogs.DescribeLogGroupsInput{
 		LogGroupNamePrefix: aws.String(group),
-	})
-	if err != nil {
-		return false, err
 	}
-	for _, matchedGroup := range resp.LogGroups {
-		if *matchedGroup.LogGroupName == group {
-			return true, nil
+	for {
+		resp, err := svc.DescribeLogGroups(params)
+		if err != nil {
+			return false, err
 		}
+		for _, matchedGroup := range resp.LogGroups {
+			if aws.StringValue(matchedGroup.LogGroupName) == group {
+				return true, nil
+			}
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			return false, nil
+		}
+		params.NextToken = resp.NextToken
 	}
-	return false, nil
 }
 
-func (u *CloudwatchUploader) createGroup(group string) error {
+// polls for a log group that was just created until it is listed, for up
+// to the group creation wait, so that streams aren't created in it before
+// it is visible. A group not listed in time is used anyway.
+func (u *CloudwatchUploader) awaitGroup(svc *cloudwatchlogs.CloudWatchLogs,
+	group string) error {
+	deadline := time.Now().Add(u.groupCreateWait)
+	for time.Now().Before(deadline) {
+		exists, err := u.groupExists(svc, group)
+		if err != nil || exists {
+			return err
+		}
+		time.Sleep(CREATE_POLL_INTERVAL)
+	}
+	u.log("Group %s not listed %s after creation", group, u.groupCreateWait)
+	return nil
+}
+
+func (u *CloudwatchUploader) createGroup(svc *cloudwatchlogs.CloudWatchLogs,
+	group string) error {
 	u.log("Creating group: %s...", group)
 	params := &cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: aws.String(group),
 	}
-	if _, err := u.svc.CreateLogGroup(params); err != nil {
+	if _, _, logClass, logClassConfigured := u.adapter.groupSettings(group); logClassConfigured {
+		params.LogGroupClass = aws.String(logClass)
+	}
+	if _, err := svc.CreateLogGroup(params); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (u *CloudwatchUploader) createGroupRetentionPolicy(group string, retentionInDays int64) error {
+func (u *CloudwatchUploader) createGroupRetentionPolicy(svc *cloudwatchlogs.CloudWatchLogs,
+	group string, retentionInDays int64) error {
 	u.log("Creating group retention policy for %s, days: %d...", group, retentionInDays)
 	params := &cloudwatchlogs.PutRetentionPolicyInput{
-		LogGroupName: aws.String(group),
+		LogGroupName:    aws.String(group),
 		RetentionInDays: aws.Int64(retentionInDays),
 	}
-	if _, err := u.svc.PutRetentionPolicy(params); err != nil {
+	if _, err := svc.PutRetentionPolicy(params); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (u *CloudwatchUploader) createStream(group, stream string) error {
+func (u *CloudwatchUploader) createStream(svc *cloudwatchlogs.CloudWatchLogs,
+	group, stream string) error {
 	u.log("Creating stream for group %s, stream %s...", group, stream)
 	params := &cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  aws.String(group),
 		LogStreamName: aws.String(stream),
 	}
-	if _, err := u.svc.CreateLogStream(params); err != nil {
+	if _, err := svc.CreateLogStream(params); err != nil {
 		return err
 	}
 	return nil
 }
 
+// returns the client for the given role ARN, which assumes that role with
+// credentials that are renewed a little before they expire, so no request
+// fails at the expiry boundary - or the default client, for an empty role.
+func (u *CloudwatchUploader) client(role string) *cloudwatchlogs.CloudWatchLogs {
+	if role == "" {
+		return u.svc
+	}
+	if svc, exists := u.roles[role]; exists {
+		return svc
+	}
+	u.log("Creating AWS Cloudwatch client for role %s", role)
+	svc := cloudwatchlogs.New(u.session, u.config.Copy(&aws.Config{
+		Credentials: stscreds.NewCredentials(u.session, role,
+			func(provider *stscreds.AssumeRoleProvider) {
+				provider.Duration = u.roleDuration
+				provider.ExpiryWindow = u.roleRenewal
+			}),
+	}))
+	u.roles[role] = svc
+	return svc
+}
+
 // HELPER METHODS
 
+// AWS SDK log levels, which may be combined in a comma-separated list
+var awsLogLevels = map[string]aws.LogLevelType{
+	`LogDebug`:                    aws.LogDebug,
+	`LogDebugWithSigning`:         aws.LogDebugWithSigning,
+	`LogDebugWithHTTPBody`:        aws.LogDebugWithHTTPBody,
+	`LogDebugWithRequestRetries`:  aws.LogDebugWithRequestRetries,
+	`LogDebugWithRequestErrors`:   aws.LogDebugWithRequestErrors,
+	`LogDebugWithEventStreamBody`: aws.LogDebugWithEventStreamBody,
+}
+
+func parseAWSLogLevel(text string) (aws.LogLevelType, error) {
+	logLevel := aws.LogOff
+	for _, name := range strings.Split(text, `,`) {
+		level, exists := awsLogLevels[strings.TrimSpace(name)]
+		if !exists {
+			return aws.LogOff, fmt.Errorf("unknown AWS SDK log level %s", name)
+		}
+		logLevel |= level
+	}
+	return logLevel, nil
+}
+
+// returns the region to upload to: LOGSPOUT_CLOUDWATCH_REGION, from the route
+// options or the environment, then the route address, unless it is "auto" or
+// empty, and then the region of the instance - which is itself the region
+// option, if set, or else the region read from EC2.
+func uploadRegion(route *router.Route, instanceRegion string) string {
+	if region := routeOption(route, `LOGSPOUT_CLOUDWATCH_REGION`, ""); region != "" {
+		return region
+	}
+	if route.Address != "auto" && route.Address != "" {
+		return route.Address
+	}
+	return instanceRegion
+}
+
+// returns an endpoint resolver that sends Cloudwatch Logs requests to the
+// given URL, such as a VPC interface endpoint, and resolves other services
+// (such as STS, when assuming roles) as usual. Requests are still signed for
+// the configured region, and TLS uses the endpoint's own host name.
+func logsEndpointResolver(endpoint string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string,
+		options ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == cloudwatchlogs.EndpointsID {
+			return endpoints.ResolvedEndpoint{
+				URL:           endpoint,
+				SigningRegion: region,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, options...)
+	})
+}
+
+// returns an HTTP transport for AWS requests, like Go's default transport,
+// but keeping more idle connections to each host, since every request goes
+// to the same Cloudwatch Logs endpoint. Its limits can be set with options.
+func newTransport(route *router.Route) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = routeIntOption(route,
+		`LOGSPOUT_CLOUDWATCH_MAX_IDLE_CONNS`, transport.MaxIdleConns)
+	transport.MaxIdleConnsPerHost = routeIntOption(route,
+		`LOGSPOUT_CLOUDWATCH_MAX_IDLE_CONNS_PER_HOST`, DEFAULT_MAX_IDLE_CONNS_PER_HOST)
+	transport.IdleConnTimeout = routeDurationOption(route,
+		`LOGSPOUT_CLOUDWATCH_IDLE_CONN_TIMEOUT`, transport.IdleConnTimeout)
+	dialer := &net.Dialer{
+		Timeout: DIAL_TIMEOUT,
+		KeepAlive: routeDurationOption(route,
+			`LOGSPOUT_CLOUDWATCH_KEEP_ALIVE`, DEFAULT_KEEP_ALIVE),
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// returns the interval between requests that keeps to the given number of
+// transactions per second, or zero for no limit
+func tpsInterval(tps int) time.Duration {
+	if tps <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(tps)
+}
+
+// waits until another PutLogEvents request can be made without exceeding
+// LOGSPOUT_CLOUDWATCH_PUTLOGEVENTS_TPS, if set. Requests are made one at a
+// time, so spacing them evenly keeps to the quota. Batches wait in the
+// queue meanwhile, as they do while AWS is slow.
+func (u *CloudwatchUploader) waitForQuota() {
+	if u.putInterval <= 0 {
+		return
+	}
+	time.Sleep(time.Until(u.lastPut.Add(u.putInterval)))
+	u.lastPut = time.Now()
+}
+
+// returns the AWS error code of an error, or OTHER_ERROR_CODE
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return OTHER_ERROR_CODE
+}
+
 func (u *CloudwatchUploader) log(format string, args ...interface{}) {
 	if u.debugSet {
 		msg := fmt.Sprintf(format, args...)
@@ -224,3 +892,115 @@ func (u *CloudwatchUploader) log(format string, args ...interface{}) {
 		log.Print(msg)
 	}
 }
+
+// logs an error uploading the given batch, naming the containers it came
+// from, and notes if access to its stream was denied. An error identical to
+// the stream's previous one is not logged again, but counted, and the count
+// of these repeats is logged at most once every ERROR_SUMMARY_INTERVAL.
+// Every error is counted by its code, and in metrics-only mode, that is all.
+func (u *CloudwatchUploader) logError(batch CloudwatchBatch, err error) {
+	msg := batch.Msgs[0]
+	id := msg.logStream()
+	code := errorCode(err)
+	if code == ACCESS_DENIED_CODE {
+		u.denied[id] = time.Now()
+	}
+	u.adapter.stats.Add(`upload_errors_`+code, 1)
+	if u.metricsOnly {
+		u.rollup[code]++
+		return
+	}
+	previous, exists := u.errors[id]
+	if exists && previous.Text == err.Error() {
+		previous.Suppressed++
+		if time.Since(previous.Summarized) >= ERROR_SUMMARY_INTERVAL {
+			u.logSuppressed(id, previous)
+		}
+		return
+	}
+	if exists && previous.Suppressed > 0 {
+		u.logSuppressed(id, previous)
+	}
+	log.Printf("cloudwatch: ERROR uploading to %s-%s from %s: %s\n",
+		msg.Group, msg.Stream, batch.sources(), err)
+	u.errors[id] = &repeatedError{Text: err.Error(), Summarized: time.Now()}
+}
+
+// forgets the previous error for the given message's stream, after a
+// successful upload, logging any repeats that were not yet summarized.
+func (u *CloudwatchUploader) clearErrors(msg CloudwatchMessage) {
+	id := msg.logStream()
+	delete(u.denied, id)
+	if previous, exists := u.errors[id]; exists {
+		if previous.Suppressed > 0 {
+			u.logSuppressed(id, previous)
+		}
+		delete(u.errors, id)
+	}
+}
+
+// logs how many errors of each code occurred since the last rollup, in
+// metrics-only mode
+func (u *CloudwatchUploader) logRollup() {
+	if len(u.rollup) == 0 {
+		return
+	}
+	codes := []string{}
+	for code, count := range u.rollup {
+		codes = append(codes, fmt.Sprintf("%s x%d", code, count))
+	}
+	sort.Strings(codes)
+	log.Printf("cloudwatch: ERROR uploading in the last %s: %s\n",
+		ERROR_SUMMARY_INTERVAL, strings.Join(codes, ", "))
+	u.rollup = map[string]int64{}
+}
+
+// returns a sample of the message affected by a problem, to append to its
+// warning, if samples are enabled - with any text matching the redaction
+// pattern hidden, and truncated. At most REJECTED_SAMPLES samples are
+// returned every ERROR_SUMMARY_INTERVAL.
+func (u *CloudwatchUploader) sample(problem batchProblem) string {
+	if !u.samples || problem.Sample == "" {
+		return ""
+	}
+	if time.Since(u.sampleStarted) >= ERROR_SUMMARY_INTERVAL {
+		u.sampleCount = 0
+		u.sampleStarted = time.Now()
+	}
+	if u.sampleCount >= REJECTED_SAMPLES {
+		return ""
+	}
+	u.sampleCount++
+	text := problem.Sample
+	if u.sampleRedact != nil {
+		text = u.sampleRedact.ReplaceAllString(text, REDACTED)
+	}
+	if len(text) > REJECTED_SAMPLE_LENGTH {
+		text = strings.ToValidUTF8(text[:REJECTED_SAMPLE_LENGTH], "") + "..."
+	}
+	return fmt.Sprintf(": %q", text)
+}
+
+// counts a batch that had no valid messages. An occasional empty batch is
+// normal, but more than the warning threshold in an ERROR_SUMMARY_INTERVAL
+// suggests something is wrong upstream, so that is warned of, once for each
+// interval.
+func (u *CloudwatchUploader) countEmpty() {
+	u.adapter.stats.Add(`empty_batches`, 1)
+	if time.Since(u.emptyStarted) >= ERROR_SUMMARY_INTERVAL {
+		u.emptyCount = 0
+		u.emptyStarted = time.Now()
+	}
+	u.emptyCount++
+	if u.emptyCount == u.emptyWarning+1 {
+		log.Printf("cloudwatch: WARNING more than %d empty batches in %s\n",
+			u.emptyWarning, ERROR_SUMMARY_INTERVAL)
+	}
+}
+
+func (u *CloudwatchUploader) logSuppressed(id streamID, repeated *repeatedError) {
+	log.Printf("cloudwatch: ERROR uploading to %s-%s repeated %d more times: %s\n",
+		id.Group, id.Stream, repeated.Suppressed, repeated.Text)
+	repeated.Suppressed = 0
+	repeated.Summarized = time.Now()
+}
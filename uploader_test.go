@@ -0,0 +1,81 @@
+package cloudwatch
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/gliderlabs/logspout/router"
+)
+
+func TestUploadRegionPrecedence(t *testing.T) {
+	tests := []struct {
+		option, env, address, ec2, want string
+	}{
+		{``, ``, ``, `us-east-1`, `us-east-1`},
+		{``, ``, `auto`, `us-east-1`, `us-east-1`},
+		{``, ``, `eu-west-1`, `us-east-1`, `eu-west-1`},
+		{``, `ap-south-1`, `eu-west-1`, `us-east-1`, `ap-south-1`},
+		{`sa-east-1`, `ap-south-1`, `eu-west-1`, `us-east-1`, `sa-east-1`},
+		{``, ``, ``, ``, ``},
+	}
+	for _, test := range tests {
+		t.Setenv(`LOGSPOUT_CLOUDWATCH_REGION`, test.env)
+		route := &router.Route{Address: test.address, Options: map[string]string{}}
+		if test.option != "" {
+			route.Options[`LOGSPOUT_CLOUDWATCH_REGION`] = test.option
+		}
+		if region := uploadRegion(route, test.ec2); region != test.want {
+			t.Errorf("%+v: got %q", test, region)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		delay  time.Duration
+		hinted bool
+	}{
+		{``, 0, false},
+		{`2`, 2 * time.Second, true},
+		{`3600`, MAX_RETRY_AFTER, true},
+		{now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{`soon`, 0, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.header != "" {
+			resp.Header.Set(`Retry-After`, test.header)
+		}
+		if delay, hinted := retryAfter(resp, now); delay != test.delay || hinted != test.hinted {
+			t.Errorf("%q: got %s, %t, want %s, %t",
+				test.header, delay, hinted, test.delay, test.hinted)
+		}
+	}
+}
+
+func TestThrottledDescribeWaitsForRetryAfter(t *testing.T) {
+	f := newFakeCloudwatch(t)
+	f.groups[`g`] = true
+	f.streams[`g/s`] = &fakeStream{}
+	f.failures[`DescribeLogStreams`] = []string{`ThrottlingException`}
+	f.retryAfter = `1`
+	u := f.adapter(t, map[string]string{}).batcher.uploader
+	params := &cloudwatchlogs.DescribeLogStreamsInput{LogGroupName: aws.String(`g`),
+		LogStreamNamePrefix: aws.String(`s`)}
+	started := time.Now()
+	if _, err := u.describeStreamsPage(u.client(``), params); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(started); waited < time.Second {
+		t.Errorf("retried after %s, want the hinted 1s", waited)
+	}
+	if count := f.count(`DescribeLogStreams`); count != 2 {
+		t.Errorf("made %d requests, want 2", count)
+	}
+}